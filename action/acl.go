@@ -67,7 +67,10 @@ func (a *ACLDelete) String() string {
 }
 
 // ACLSet action
+//
+// ACLs are matched by name. ID is only used when the ACL is created.
 type ACLSet struct {
+	ID    string `json:",omitempty"`
 	Name  string
 	Rules string
 }
@@ -108,6 +111,7 @@ func (a *ACLSet) Action(c *Ctx) error {
 	if !updated {
 		_, _, err = c.API.ACL().Create(
 			&api.ACLEntry{
+				ID:    a.ID,
 				Name:  a.Name,
 				Type:  api.ACLClientType,
 				Rules: a.Rules,
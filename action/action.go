@@ -1,7 +1,9 @@
 package action
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 
 	api "github.com/armon/consul-api"
 )
@@ -56,7 +58,84 @@ type Actioner interface {
 	String() string
 }
 
+// DirResolver is implemented by actions that reference files relative to
+// the file that they were loaded from.
+type DirResolver interface {
+	// ResolveDir resolves any relative file references against dir.
+	ResolveDir(dir string)
+}
+
+// FileReferencer is implemented by actions that read other files when they
+// are applied.
+type FileReferencer interface {
+	// Files returns the files and directories that the action reads.
+	Files() []string
+}
+
+// OutputReporter is implemented by actions that capture output when they
+// are performed.
+type OutputReporter interface {
+	// Output returns the output from the last time the action was performed.
+	Output() string
+}
+
 //Ctx provides context information to the Actioner.
 type Ctx struct {
 	API *api.Client
+	// Context is done when the action should stop. When the Ctx is created
+	// by WithContext the API requests are also bound to it.
+	Context context.Context
+	config  *api.Config
+}
+
+// NewCtx returns a Ctx with an API client for the config.
+func NewCtx(config *api.Config) (Ctx, error) {
+	client, err := api.NewClient(config)
+	if err != nil {
+		return Ctx{}, err
+	}
+	return Ctx{API: client, Context: context.Background(), config: config}, nil
+}
+
+// WithContext returns a copy of the Ctx where the API requests are bound to
+// ctx, so that they are cancelled when it is done.
+func (c *Ctx) WithContext(ctx context.Context) *Ctx {
+	n := *c
+	n.Context = ctx
+	if c.config == nil {
+		return &n
+	}
+	config := *c.config
+	client := http.DefaultClient
+	if config.HttpClient != nil {
+		client = config.HttpClient
+	}
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	config.HttpClient = &http.Client{
+		Transport: contextTransport{ctx, transport},
+		Timeout:   client.Timeout,
+	}
+	n.API, _ = api.NewClient(&config)
+	return &n
+}
+
+// Err returns the error from the context once it is done, otherwise nil.
+func (c *Ctx) Err() error {
+	if c.Context == nil {
+		return nil
+	}
+	return c.Context.Err()
+}
+
+// contextTransport binds each request to a context.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t contextTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(r.WithContext(t.ctx))
 }
@@ -0,0 +1,206 @@
+package action
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	api "github.com/armon/consul-api"
+)
+
+func init() {
+	DefaultFactories = append(
+		DefaultFactories,
+		func(id string) (Actioner, error) {
+			switch id {
+			case "ConfigEntryDelete":
+				return &ConfigEntryDelete{}, nil
+			case "ConfigEntrySet":
+				return &ConfigEntrySet{}, nil
+			}
+			return nil, UnknownFactoryIDError(id)
+		},
+	)
+}
+
+// ConfigEntryKinds are the kinds of config entry that can be managed.
+var ConfigEntryKinds = []string{
+	"service-defaults",
+	"proxy-defaults",
+	"service-router",
+	"service-splitter",
+	"service-resolver",
+	"ingress-gateway",
+	"terminating-gateway",
+}
+
+func validateConfigEntry(kind, name string) error {
+	if kind == "" {
+		return errors.New("Kind must not be empty.")
+	}
+	if name == "" {
+		return errors.New("Name must not be empty.")
+	}
+	for _, k := range ConfigEntryKinds {
+		if k == kind {
+			return nil
+		}
+	}
+	return fmt.Errorf("Kind %q is not supported.", kind)
+}
+
+// casParams returns the parameters for a check-and-set on the modify index,
+// or nil when there is no index to check.
+func casParams(modifyIndex uint64) url.Values {
+	if modifyIndex == 0 {
+		return nil
+	}
+	return url.Values{"cas": {strconv.FormatUint(modifyIndex, 10)}}
+}
+
+// ListConfigEntries returns a ConfigEntrySet for each config entry of the
+// kind.
+func ListConfigEntries(c *Ctx, kind string, q *api.QueryOptions) ([]*ConfigEntrySet, error) {
+	var raw []json.RawMessage
+	err := c.request("GET", "/v1/config/"+kind, q, nil, nil, &raw)
+	if err != nil {
+		return nil, err
+	}
+	var sets []*ConfigEntrySet
+	for _, r := range raw {
+		var entry map[string]interface{}
+		d := json.NewDecoder(bytes.NewReader(r))
+		d.UseNumber()
+		err = d.Decode(&entry)
+		if err != nil {
+			return nil, err
+		}
+		s := &ConfigEntrySet{Kind: kind}
+		s.Name, _ = entry["Name"].(string)
+		for _, k := range []string{"Kind", "Name", "CreateIndex", "ModifyIndex"} {
+			delete(entry, k)
+		}
+		if len(entry) > 0 {
+			s.Entry, err = json.Marshal(entry)
+			if err != nil {
+				return nil, err
+			}
+		}
+		sets = append(sets, s)
+	}
+	return sets, nil
+}
+
+// ConfigEntryDelete action
+//
+// When ModifyIndex is given the entry is only deleted if it has not been
+// modified since.
+type ConfigEntryDelete struct {
+	Kind        string
+	Name        string
+	ModifyIndex uint64 `json:",omitempty"`
+}
+
+// Type returns the type identifier for the actioner
+func (a *ConfigEntryDelete) Type() string {
+	return "ConfigEntryDelete"
+}
+
+// Action performs the config entry delete action
+func (a *ConfigEntryDelete) Action(c *Ctx) error {
+	path := "/v1/config/" + a.Kind + "/" + url.PathEscape(a.Name)
+	params := casParams(a.ModifyIndex)
+	if params == nil {
+		return c.request("DELETE", path, nil, nil, nil, nil)
+	}
+	var ok bool
+	err := c.request("DELETE", path, nil, params, nil, &ok)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Config entry has been modified since index %d.", a.ModifyIndex)
+	}
+	return nil
+}
+
+// Validate that the action is valid in its current state.
+func (a *ConfigEntryDelete) Validate() error {
+	return validateConfigEntry(a.Kind, a.Name)
+}
+
+// String representation of the action.
+func (a *ConfigEntryDelete) String() string {
+	return fmt.Sprintf("Config Entry Delete %q %q", a.Kind, a.Name)
+}
+
+// ConfigEntrySet action
+//
+// Entry holds the fields of the config entry other than Kind and Name. When
+// ModifyIndex is given the entry is only written if it has not been
+// modified since.
+type ConfigEntrySet struct {
+	Kind        string
+	Name        string
+	Entry       json.RawMessage `json:",omitempty"`
+	ModifyIndex uint64          `json:",omitempty"`
+}
+
+// Type returns the type identifier for the actioner
+func (a *ConfigEntrySet) Type() string {
+	return "ConfigEntrySet"
+}
+
+// body returns the config entry as it is sent to consul.
+func (a *ConfigEntrySet) body() (map[string]interface{}, error) {
+	entry := make(map[string]interface{})
+	if len(a.Entry) > 0 {
+		d := json.NewDecoder(bytes.NewReader(a.Entry))
+		d.UseNumber()
+		err := d.Decode(&entry)
+		if err != nil {
+			return nil, fmt.Errorf("Entry must be a JSON object.\n\n%s", err)
+		}
+	}
+	entry["Kind"] = a.Kind
+	entry["Name"] = a.Name
+	return entry, nil
+}
+
+// Action performs the config entry set action
+func (a *ConfigEntrySet) Action(c *Ctx) error {
+	entry, err := a.body()
+	if err != nil {
+		return err
+	}
+	var ok bool
+	err = c.request("PUT", "/v1/config", nil, casParams(a.ModifyIndex), entry, &ok)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if a.ModifyIndex != 0 {
+			return fmt.Errorf("Config entry has been modified since index %d.", a.ModifyIndex)
+		}
+		return errors.New("Config entry was not written.")
+	}
+	return nil
+}
+
+// Validate that the action is valid in its current state.
+func (a *ConfigEntrySet) Validate() error {
+	err := validateConfigEntry(a.Kind, a.Name)
+	if err != nil {
+		return err
+	}
+	_, err = a.body()
+	return err
+}
+
+// String representation of the action.
+func (a *ConfigEntrySet) String() string {
+	return fmt.Sprintf("Config Entry Set %q %q", a.Kind, a.Name)
+}
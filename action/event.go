@@ -0,0 +1,81 @@
+package action
+
+import (
+	"errors"
+	"fmt"
+
+	api "github.com/armon/consul-api"
+)
+
+func init() {
+	DefaultFactories = append(
+		DefaultFactories,
+		func(id string) (Actioner, error) {
+			switch id {
+			case "EventFire":
+				return &EventFire{}, nil
+			}
+			return nil, UnknownFactoryIDError(id)
+		},
+	)
+}
+
+// EventFire action
+//
+// Fires a user event so that watches on the agents can react to the
+// changes made by the actions before it. The event only goes to the agents
+// that match NodeFilter, ServiceFilter and TagFilter, which are regular
+// expressions.
+type EventFire struct {
+	Name          string
+	Payload       string `json:",omitempty"`
+	NodeFilter    string `json:",omitempty"`
+	ServiceFilter string `json:",omitempty"`
+	TagFilter     string `json:",omitempty"`
+}
+
+// Type returns the type identifier for the actioner
+func (a *EventFire) Type() string {
+	return "EventFire"
+}
+
+// Action fires the event.
+func (a *EventFire) Action(c *Ctx) error {
+	e := &api.UserEvent{
+		Name:          a.Name,
+		NodeFilter:    a.NodeFilter,
+		ServiceFilter: a.ServiceFilter,
+		TagFilter:     a.TagFilter,
+	}
+	if a.Payload != "" {
+		e.Payload = []byte(a.Payload)
+	}
+	_, _, err := c.API.Event().Fire(e, nil)
+	return err
+}
+
+// Validate that the action is valid in its current state.
+func (a *EventFire) Validate() error {
+	if a.Name == "" {
+		return errors.New("Name must not be empty.")
+	}
+	if a.TagFilter != "" && a.ServiceFilter == "" {
+		return errors.New("ServiceFilter must not be empty when TagFilter is given.")
+	}
+	return nil
+}
+
+// String representation of the action.
+func (a *EventFire) String() string {
+	s := fmt.Sprintf("Event Fire %q %q", a.Name, a.Payload)
+	if a.NodeFilter != "" {
+		s += fmt.Sprintf(" node=%q", a.NodeFilter)
+	}
+	if a.ServiceFilter != "" {
+		s += fmt.Sprintf(" service=%q", a.ServiceFilter)
+	}
+	if a.TagFilter != "" {
+		s += fmt.Sprintf(" tag=%q", a.TagFilter)
+	}
+	return s
+}
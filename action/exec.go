@@ -0,0 +1,145 @@
+package action
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	DefaultFactories = append(
+		DefaultFactories,
+		func(id string) (Actioner, error) {
+			switch id {
+			case "Exec":
+				return &Exec{}, nil
+			}
+			return nil, UnknownFactoryIDError(id)
+		},
+	)
+}
+
+// Exec action
+//
+// Command is run without a shell, in Dir which defaults to the directory of
+// the action file. The consul connection is given in the CONSUL_HTTP_ADDR,
+// CONSUL_HTTP_TOKEN and CONSUL_DATACENTER environment variables along with
+// Env. STDOUT and STDERR are captured together. Timeout is a duration such
+// as "30s".
+type Exec struct {
+	Command       []string
+	Dir           string            `json:",omitempty"`
+	Env           map[string]string `json:",omitempty"`
+	Timeout       string            `json:",omitempty"`
+	IgnoreFailure bool              `json:",omitempty"`
+	output        string
+}
+
+// Type returns the type identifier for the actioner
+func (a *Exec) Type() string {
+	return "Exec"
+}
+
+// Action runs the command.
+func (a *Exec) Action(c *Ctx) error {
+	parent := c.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx := parent
+	if a.Timeout != "" {
+		d, err := time.ParseDuration(a.Timeout)
+		if err != nil {
+			return err
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, a.Command[0], a.Command[1:]...)
+	cmd.Dir = a.Dir
+	cmd.Env = append(os.Environ(), c.env()...)
+	var keys []string
+	for k := range a.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cmd.Env = append(cmd.Env, k+"="+a.Env[k])
+	}
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	a.output = out.String()
+	if err == nil || a.IgnoreFailure {
+		return nil
+	}
+	switch {
+	case parent.Err() != nil:
+		// The deadline or cancellation came from the caller, not Timeout.
+		err = fmt.Errorf("Stopped before the command finished.\n\n%s", parent.Err())
+	case ctx.Err() == context.DeadlineExceeded:
+		err = fmt.Errorf("Timed out after %s.", a.Timeout)
+	}
+	if o := strings.TrimSpace(a.output); o != "" {
+		return fmt.Errorf("Unable to run %q.\n\n%s\n\n%s", a.Command[0], err, o)
+	}
+	return fmt.Errorf("Unable to run %q.\n\n%s", a.Command[0], err)
+}
+
+// Output returns what the command wrote the last time that it was run.
+func (a *Exec) Output() string {
+	return a.output
+}
+
+// ResolveDir runs the command in the directory of the action file unless
+// Dir says otherwise.
+func (a *Exec) ResolveDir(dir string) {
+	if a.Dir == "" {
+		a.Dir = dir
+	} else if !filepath.IsAbs(a.Dir) {
+		a.Dir = filepath.Join(dir, a.Dir)
+	}
+}
+
+// Validate that the action is valid in its current state.
+func (a *Exec) Validate() error {
+	if len(a.Command) == 0 || a.Command[0] == "" {
+		return errors.New("Command must not be empty.")
+	}
+	if a.Timeout != "" {
+		if _, err := time.ParseDuration(a.Timeout); err != nil {
+			return fmt.Errorf("Timeout is not a valid duration.\n\n%s", err)
+		}
+	}
+	return nil
+}
+
+// String representation of the action.
+func (a *Exec) String() string {
+	return fmt.Sprintf("Exec %q", strings.Join(a.Command, " "))
+}
+
+// env returns the environment variables that describe the consul
+// connection.
+func (c *Ctx) env() []string {
+	if c.config == nil {
+		return nil
+	}
+	env := []string{"CONSUL_HTTP_ADDR=" + c.config.Scheme + "://" + c.config.Address}
+	if c.config.Token != "" {
+		env = append(env, "CONSUL_HTTP_TOKEN="+c.config.Token)
+	}
+	if c.config.Datacenter != "" {
+		env = append(env, "CONSUL_DATACENTER="+c.config.Datacenter)
+	}
+	return env
+}
@@ -0,0 +1,32 @@
+package action
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecTimeout(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		timeout string
+		want    string
+	}{
+		{"own timeout", context.Background(), "50ms", "Timed out after 50ms."},
+		{"caller deadline", expired, "", "Stopped before the command finished."},
+		{"caller deadline first", expired, "1m", "Stopped before the command finished."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Exec{Command: []string{"sleep", "5"}, Timeout: tt.timeout}
+			err := a.Action(&Ctx{Context: tt.ctx})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -56,6 +56,9 @@ func (a *ExternalNodeRegister) Action(c *Ctx) error {
 		return err
 	}
 	for _, s := range a.Services {
+		if err := c.Err(); err != nil {
+			return err
+		}
 		_, err := c.API.Catalog().Register(
 			&api.CatalogRegistration{
 				Node:    a.Node,
@@ -130,6 +133,9 @@ func (a *ExternalNodeDeregister) Action(c *Ctx) error {
 		}
 	} else {
 		for _, s := range a.Services {
+			if err := c.Err(); err != nil {
+				return err
+			}
 			_, err := c.API.Catalog().Deregister(
 				&api.CatalogDeregistration{
 					Node:      a.Node,
@@ -0,0 +1,78 @@
+package action
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	api "github.com/armon/consul-api"
+)
+
+// request makes a request to the consul HTTP API for the endpoints that the
+// api client does not support. in is sent as the JSON body when it is not
+// nil, and the JSON response is decoded into out when it is not nil.
+func (c *Ctx) request(method, path string, q *api.QueryOptions, params url.Values, in, out interface{}) error {
+	if c.config == nil {
+		return fmt.Errorf("Unable to make a request to %q without a consul config.", path)
+	}
+	if params == nil {
+		params = make(url.Values)
+	}
+	if c.config.Datacenter != "" {
+		params.Set("dc", c.config.Datacenter)
+	}
+	if c.config.Token != "" {
+		params.Set("token", c.config.Token)
+	}
+	if q != nil {
+		if q.AllowStale {
+			params.Set("stale", "")
+		}
+		if q.RequireConsistent {
+			params.Set("consistent", "")
+		}
+	}
+	u := &url.URL{
+		Scheme:   c.config.Scheme,
+		Host:     c.config.Address,
+		Path:     path,
+		RawQuery: params.Encode(),
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	if c.Context != nil {
+		req = req.WithContext(c.Context)
+	}
+	client := c.config.HttpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		// The same error as the api client, so that it is retried the same.
+		return fmt.Errorf("Unexpected response code: %d (%s)", resp.StatusCode, bytes.TrimSpace(b))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
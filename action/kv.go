@@ -1,8 +1,16 @@
 package action
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	api "github.com/armon/consul-api"
 )
@@ -20,6 +28,10 @@ func init() {
 				return &KVSet{}, nil
 			case "KVSetIfNotExist":
 				return &KVSetIfNotExist{}, nil
+			case "KVSetTree":
+				return &KVSetTree{}, nil
+			case "KVSetDocument":
+				return &KVSetDocument{}, nil
 			}
 			return nil, UnknownFactoryIDError(id)
 		},
@@ -84,11 +96,92 @@ func (a *KVDeleteTree) String() string {
 	return fmt.Sprintf("KV Delete Tree %q", a.Prefix)
 }
 
+// KVValue holds the value of a key. Only one of the value sources should be
+// provided. ValueFile is relative to the file the action was loaded from.
+type KVValue struct {
+	Value       string
+	ValueFile   string          `json:",omitempty"`
+	ValueBase64 string          `json:",omitempty"`
+	ValueJSON   json.RawMessage `json:",omitempty"`
+}
+
+// Bytes returns the raw value from whichever source is provided.
+func (v *KVValue) Bytes() ([]byte, error) {
+	switch {
+	case v.ValueFile != "":
+		return ioutil.ReadFile(v.ValueFile)
+	case v.ValueBase64 != "":
+		return base64.StdEncoding.DecodeString(v.ValueBase64)
+	case len(v.ValueJSON) > 0:
+		var b bytes.Buffer
+		err := json.Compact(&b, v.ValueJSON)
+		return b.Bytes(), err
+	}
+	return []byte(v.Value), nil
+}
+
+// ResolveDir makes a relative ValueFile relative to dir.
+func (v *KVValue) ResolveDir(dir string) {
+	if v.ValueFile != "" && !filepath.IsAbs(v.ValueFile) {
+		v.ValueFile = filepath.Join(dir, v.ValueFile)
+	}
+}
+
+// Files returns the value file if there is one.
+func (v *KVValue) Files() []string {
+	if v.ValueFile == "" {
+		return nil
+	}
+	return []string{v.ValueFile}
+}
+
+// Validate that the value is valid in its current state.
+func (v *KVValue) Validate() error {
+	n := 0
+	if v.Value != "" {
+		n++
+	}
+	if v.ValueFile != "" {
+		n++
+	}
+	if v.ValueBase64 != "" {
+		n++
+		if _, err := base64.StdEncoding.DecodeString(v.ValueBase64); err != nil {
+			return fmt.Errorf("ValueBase64 is not valid base64. %s", err)
+		}
+	}
+	if len(v.ValueJSON) > 0 {
+		n++
+	}
+	if n > 1 {
+		return errors.New("Only one of Value, ValueFile, ValueBase64 or ValueJSON may be set.")
+	}
+	return nil
+}
+
+// String representation of the value.
+func (v *KVValue) String() string {
+	switch {
+	case v.ValueFile != "":
+		return fmt.Sprintf("file %q", v.ValueFile)
+	case v.ValueBase64 != "":
+		return fmt.Sprintf("base64 %q", v.ValueBase64)
+	case len(v.ValueJSON) > 0:
+		return fmt.Sprintf("json %s", v.ValueJSON)
+	}
+	return fmt.Sprintf("%q", v.Value)
+}
+
 // KVSet action
+//
+// When ModifyIndex or ExpectedValue is provided the key is only set if it
+// has not been changed since, so that changes made by hand are not clobbered.
 type KVSet struct {
 	Key   string
 	Flags uint64
-	Value string
+	KVValue
+	ModifyIndex   uint64  `json:",omitempty"`
+	ExpectedValue *string `json:",omitempty"`
 }
 
 // Type returns the type identifier for the actioner
@@ -98,13 +191,45 @@ func (a *KVSet) Type() string {
 
 // Action performs the KV set action
 func (a *KVSet) Action(c *Ctx) error {
+	v, err := a.Bytes()
+	if err != nil {
+		return err
+	}
 	p := &api.KVPair{
 		Key:   a.Key,
 		Flags: a.Flags,
-		Value: []byte(a.Value),
+		Value: v,
 	}
-	_, err := c.API.KV().Put(p, nil)
-	return err
+	if a.ModifyIndex == 0 && a.ExpectedValue == nil {
+		_, err = c.API.KV().Put(p, nil)
+		return err
+	}
+	q := &api.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+	}
+	current, _, err := c.API.KV().Get(a.Key, q)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf("Key %q does not exist.", a.Key)
+	}
+	if a.ModifyIndex != 0 && current.ModifyIndex != a.ModifyIndex {
+		return fmt.Errorf("Key %q has been modified, expected index %d but found %d with value %q.", a.Key, a.ModifyIndex, current.ModifyIndex, current.Value)
+	}
+	if a.ExpectedValue != nil && string(current.Value) != *a.ExpectedValue {
+		return fmt.Errorf("Key %q has been modified, expected value %q but found %q.", a.Key, *a.ExpectedValue, current.Value)
+	}
+	p.ModifyIndex = current.ModifyIndex
+	ok, _, err := c.API.KV().CAS(p, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Key %q was modified while it was being set.", a.Key)
+	}
+	return nil
 }
 
 // Validate that the action is valid in its current state.
@@ -112,19 +237,19 @@ func (a *KVSet) Validate() error {
 	if a.Key == "" {
 		return errors.New("Key must not be empty.")
 	}
-	return nil
+	return a.KVValue.Validate()
 }
 
 // String representation of the action.
 func (a *KVSet) String() string {
-	return fmt.Sprintf("KV Set %q %d %q", a.Key, a.Flags, a.Value)
+	return fmt.Sprintf("KV Set %q %d %s", a.Key, a.Flags, a.KVValue.String())
 }
 
 // KVSetIfNotExist action
 type KVSetIfNotExist struct {
 	Key   string
 	Flags uint64
-	Value string
+	KVValue
 }
 
 // Type returns the type identifier for the actioner
@@ -134,12 +259,16 @@ func (a *KVSetIfNotExist) Type() string {
 
 // Action performs the KV set if not exist action
 func (a *KVSetIfNotExist) Action(c *Ctx) error {
+	v, err := a.Bytes()
+	if err != nil {
+		return err
+	}
 	p := &api.KVPair{
 		Key:   a.Key,
 		Flags: a.Flags,
-		Value: []byte(a.Value),
+		Value: v,
 	}
-	_, _, err := c.API.KV().CAS(p, nil)
+	_, _, err = c.API.KV().CAS(p, nil)
 	return err
 }
 
@@ -148,10 +277,250 @@ func (a *KVSetIfNotExist) Validate() error {
 	if a.Key == "" {
 		return errors.New("Key must not be empty.")
 	}
-	return nil
+	return a.KVValue.Validate()
 }
 
 // String representation of the action.
 func (a *KVSetIfNotExist) String() string {
-	return fmt.Sprintf("KV Set If Not Exist %q %d %q", a.Key, a.Flags, a.Value)
+	return fmt.Sprintf("KV Set If Not Exist %q %d %s", a.Key, a.Flags, a.KVValue.String())
+}
+
+// KVFlagsSuffix is appended to the file name of a key in a KV tree directory
+// to give the name of the sidecar file that holds the flags for the key.
+const KVFlagsSuffix = ".flags"
+
+// KVSetTree action
+type KVSetTree struct {
+	Prefix string
+	Dir    string
+}
+
+// Type returns the type identifier for the actioner
+func (a *KVSetTree) Type() string {
+	return "KVSetTree"
+}
+
+// Action performs the KV set tree action
+func (a *KVSetTree) Action(c *Ctx) error {
+	pairs, err := a.Pairs()
+	if err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		if err = c.Err(); err != nil {
+			return err
+		}
+		_, err = c.API.KV().Put(p, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pairs loads the key value pairs from the directory. Each file is a key and
+// its content is the value. Empty directories become keys ending in a "/".
+func (a *KVSetTree) Pairs() (api.KVPairs, error) {
+	var pairs api.KVPairs
+	err := filepath.Walk(a.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(a.Dir, path)
+		if err != nil {
+			return err
+		}
+		key := a.KeyPrefix() + filepath.ToSlash(rel)
+		if info.IsDir() {
+			if rel == "." {
+				return nil
+			}
+			entries, err := ioutil.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			if len(entries) == 0 {
+				pairs = append(pairs, &api.KVPair{Key: key + "/"})
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, KVFlagsSuffix) {
+			return nil
+		}
+		p := &api.KVPair{Key: key}
+		p.Value, err = ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		f, err := ioutil.ReadFile(path + KVFlagsSuffix)
+		if err == nil {
+			p.Flags, err = strconv.ParseUint(strings.TrimSpace(string(f)), 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid flags for %q. %s", key, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		pairs = append(pairs, p)
+		return nil
+	})
+	return pairs, err
+}
+
+// KeyPrefix returns Prefix ending in a "/", so that the files in Dir become
+// keys under it. An empty Prefix is the root of the KV store.
+func (a *KVSetTree) KeyPrefix() string {
+	if a.Prefix == "" || strings.HasSuffix(a.Prefix, "/") {
+		return a.Prefix
+	}
+	return a.Prefix + "/"
+}
+
+// ResolveDir makes a relative Dir relative to dir.
+func (a *KVSetTree) ResolveDir(dir string) {
+	if a.Dir != "" && !filepath.IsAbs(a.Dir) {
+		a.Dir = filepath.Join(dir, a.Dir)
+	}
+}
+
+// Files returns the directory that the tree is loaded from.
+func (a *KVSetTree) Files() []string {
+	return []string{a.Dir}
+}
+
+// Validate that the action is valid in its current state.
+func (a *KVSetTree) Validate() error {
+	if a.Dir == "" {
+		return errors.New("Dir must not be empty.")
+	}
+	return nil
+}
+
+// String representation of the action.
+func (a *KVSetTree) String() string {
+	return fmt.Sprintf("KV Set Tree %q from %q", a.Prefix, a.Dir)
+}
+
+// KVSetDocument action
+type KVSetDocument struct {
+	Prefix   string
+	Document json.RawMessage
+	Prune    bool
+}
+
+// Type returns the type identifier for the actioner
+func (a *KVSetDocument) Type() string {
+	return "KVSetDocument"
+}
+
+// Action performs the KV set document action
+func (a *KVSetDocument) Action(c *Ctx) error {
+	pairs, err := a.Pairs()
+	if err != nil {
+		return err
+	}
+	keep := make(map[string]bool, len(pairs))
+	for _, p := range pairs {
+		if err = c.Err(); err != nil {
+			return err
+		}
+		keep[p.Key] = true
+		_, err = c.API.KV().Put(p, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if !a.Prune {
+		return nil
+	}
+	keys, _, err := c.API.KV().Keys(a.KeyPrefix(), "", nil)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if keep[k] {
+			continue
+		}
+		if err = c.Err(); err != nil {
+			return err
+		}
+		_, err = c.API.KV().Delete(k, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pairs expands the document into one key value pair per leaf. Strings are
+// stored as they are, null as an empty value, and any other leaf as JSON.
+func (a *KVSetDocument) Pairs() (api.KVPairs, error) {
+	var doc interface{}
+	d := json.NewDecoder(bytes.NewReader(a.Document))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Document must be an object.")
+	}
+	var pairs api.KVPairs
+	err := expandKVDocument(a.KeyPrefix(), m, &pairs)
+	return pairs, err
+}
+
+// KeyPrefix returns Prefix ending in a "/", which is where the document is
+// expanded.
+func (a *KVSetDocument) KeyPrefix() string {
+	if strings.HasSuffix(a.Prefix, "/") {
+		return a.Prefix
+	}
+	return a.Prefix + "/"
+}
+
+func expandKVDocument(prefix string, m map[string]interface{}, pairs *api.KVPairs) error {
+	for k, v := range m {
+		if k == "" || strings.Contains(k, "/") {
+			return fmt.Errorf("Invalid document key %q under %q.", k, prefix)
+		}
+		key := prefix + k
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if err := expandKVDocument(key+"/", v, pairs); err != nil {
+				return err
+			}
+		case string:
+			*pairs = append(*pairs, &api.KVPair{Key: key, Value: []byte(v)})
+		case nil:
+			*pairs = append(*pairs, &api.KVPair{Key: key})
+		default:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			*pairs = append(*pairs, &api.KVPair{Key: key, Value: b})
+		}
+	}
+	return nil
+}
+
+// Validate that the action is valid in its current state.
+func (a *KVSetDocument) Validate() error {
+	if a.Prefix == "" {
+		return errors.New("Prefix must not be empty.")
+	}
+	if len(a.Document) == 0 {
+		return errors.New("Document must not be empty.")
+	}
+	_, err := a.Pairs()
+	return err
+}
+
+// String representation of the action.
+func (a *KVSetDocument) String() string {
+	if a.Prune {
+		return fmt.Sprintf("KV Set Document %q with prune", a.Prefix)
+	}
+	return fmt.Sprintf("KV Set Document %q", a.Prefix)
 }
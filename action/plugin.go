@@ -0,0 +1,202 @@
+package action
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// PluginPrefix is the start of the name of the executable that provides a
+// plugin action type, so the type Foo is provided by
+// consul-register-action-Foo.
+const PluginPrefix = "consul-register-action-"
+
+// PluginDir is searched for plugin executables before PATH when it is set.
+var PluginDir string
+
+// PluginPlanTimeout is how long a plugin is given to answer the "plan"
+// operation, which is run whenever actions are loaded.
+var PluginPlanTimeout = 30 * time.Second
+
+// PluginFactory creates a Plugin for any type that has a plugin executable.
+// It is not in DefaultFactories so that it can be added after the built in
+// types, which always take precedence.
+func PluginFactory(id string) (Actioner, error) {
+	path, err := pluginPath(id)
+	if err != nil {
+		return nil, UnknownFactoryIDError(id)
+	}
+	return &Plugin{name: id, path: path}, nil
+}
+
+// pluginID matches the action types that can be provided by a plugin. Only
+// plain names are allowed so that a type can not name a path.
+var pluginID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func pluginPath(id string) (string, error) {
+	if !pluginID.MatchString(id) {
+		return "", fmt.Errorf("Invalid plugin type %q.", id)
+	}
+	if PluginDir != "" {
+		path := filepath.Join(PluginDir, PluginPrefix+id)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return exec.LookPath(PluginPrefix + id)
+}
+
+// Plugin is an action that is performed by an external executable.
+//
+// The executable is given a JSON PluginRequest on STDIN and must write a
+// JSON PluginResponse to STDOUT. It is run with the "plan" operation when
+// the action is validated, without any connection details, and with the
+// "apply" operation when the action is performed. The Plan that it gives for
+// "apply" describes what it did and is the output of the action. Anything
+// that it writes to STDERR is passed through.
+type Plugin struct {
+	name   string
+	path   string
+	plan   string
+	output string
+	Config json.RawMessage
+}
+
+// PluginRequest is sent to a plugin on STDIN.
+type PluginRequest struct {
+	Operation string
+	Type      string
+	Config    json.RawMessage
+	Consul    *PluginConsul `json:",omitempty"`
+}
+
+// PluginConsul holds the details that a plugin needs to connect to consul.
+type PluginConsul struct {
+	Address    string
+	Scheme     string
+	Datacenter string `json:",omitempty"`
+	Token      string `json:",omitempty"`
+}
+
+// PluginResponse is read from a plugin on STDOUT. Plan describes what the
+// action does, and Error is set when the action is invalid or failed.
+type PluginResponse struct {
+	Plan  string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// Type returns the type identifier for the actioner.
+func (p *Plugin) Type() string {
+	return p.name
+}
+
+// UnmarshalJSON keeps the config as it is for the plugin.
+func (p *Plugin) UnmarshalJSON(b []byte) error {
+	p.Config = append(json.RawMessage(nil), b...)
+	return nil
+}
+
+// MarshalJSON gives the config as it was loaded.
+func (p *Plugin) MarshalJSON() ([]byte, error) {
+	if len(p.Config) == 0 {
+		return []byte("{}"), nil
+	}
+	return p.Config, nil
+}
+
+// Action performs the action using the provided context.
+func (p *Plugin) Action(c *Ctx) error {
+	req := PluginRequest{Operation: "apply", Type: p.name, Config: p.Config}
+	if c.config != nil {
+		req.Consul = &PluginConsul{
+			Address:    c.config.Address,
+			Scheme:     c.config.Scheme,
+			Datacenter: c.config.Datacenter,
+			Token:      c.config.Token,
+		}
+	}
+	res, err := p.run(c.Context, req)
+	p.output = res.Plan
+	return err
+}
+
+// Output returns the Plan that the plugin gave the last time that it was
+// applied.
+func (p *Plugin) Output() string {
+	return p.output
+}
+
+// Validate check that the action is valid in its current state.
+func (p *Plugin) Validate() error {
+	if p.path == "" {
+		return errors.New("Plugin path must not be empty.")
+	}
+	if !pluginID.MatchString(p.name) {
+		return fmt.Errorf("Invalid plugin type %q.", p.name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), PluginPlanTimeout)
+	defer cancel()
+	res, err := p.run(ctx, PluginRequest{Operation: "plan", Type: p.name, Config: p.Config})
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Plugin %q did not plan within %s.", p.path, PluginPlanTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	p.plan = res.Plan
+	return nil
+}
+
+// String to give us a user friendly identifier for the actioner.
+func (p *Plugin) String() string {
+	if p.plan != "" {
+		return fmt.Sprintf("Plugin %s %s", p.name, p.plan)
+	}
+	var b bytes.Buffer
+	if json.Compact(&b, p.Config) != nil {
+		b.Reset()
+	}
+	return fmt.Sprintf("Plugin %s %s", p.name, b.String())
+}
+
+func (p *Plugin) run(ctx context.Context, req PluginRequest) (PluginResponse, error) {
+	var (
+		res PluginResponse
+		in  bytes.Buffer
+		out bytes.Buffer
+	)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	err := json.NewEncoder(&in).Encode(req)
+	if err != nil {
+		return res, err
+	}
+	cmd := exec.CommandContext(ctx, p.path)
+	cmd.Stdin = &in
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	// Do not wait for processes that the plugin started, and that still
+	// hold its output open, once it has been stopped.
+	cmd.WaitDelay = time.Second
+	err = cmd.Run()
+	if out.Len() > 0 {
+		if jerr := json.Unmarshal(out.Bytes(), &res); jerr != nil && err == nil {
+			err = fmt.Errorf("Unable to read the response.\n\n%s", jerr)
+		}
+	}
+	if res.Error != "" {
+		return res, errors.New(res.Error)
+	}
+	if err != nil {
+		return res, fmt.Errorf("Unable to run plugin %q.\n\n%s", p.path, err)
+	}
+	return res, nil
+}
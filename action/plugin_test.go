@@ -0,0 +1,118 @@
+package action
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPluginFactory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { PluginDir = d }(PluginDir)
+	PluginDir = filepath.Join(dir, "plugins")
+	err = os.Mkdir(PluginDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{filepath.Join(PluginDir, PluginPrefix+"Hello"), filepath.Join(dir, "evil")} {
+		// evil is outside of the plugin dir, where a traversal could reach.
+		err = ioutil.WriteFile(f, []byte("#!/bin/sh\n"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		id string
+		ok bool
+	}{
+		{"Hello", true},
+		{"Missing", false},
+		{"/../../evil", false},
+		{"../evil", false},
+		{"../../evil", false},
+		{"x/../../evil", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		a, err := PluginFactory(tt.id)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("PluginFactory(%q) = %v", tt.id, err)
+			} else if a.Type() != tt.id {
+				t.Errorf("PluginFactory(%q).Type() = %q", tt.id, a.Type())
+			}
+			continue
+		}
+		if _, ok := err.(UnknownFactoryIDError); !ok {
+			t.Errorf("PluginFactory(%q) = %v, %v, want UnknownFactoryIDError", tt.id, a, err)
+		}
+	}
+}
+
+func TestPluginPathRejectsTraversal(t *testing.T) {
+	defer func(d string) { PluginDir = d }(PluginDir)
+	PluginDir = "/tmp"
+	for _, id := range []string{"/../../usr/bin/env", "../../bin/sh", "a b", "a;b"} {
+		if path, err := pluginPath(id); err == nil {
+			t.Errorf("pluginPath(%q) = %q, want an error", id, path)
+		}
+	}
+}
+
+// testPlugin writes a plugin script that runs body and returns it.
+func testPlugin(t *testing.T, dir, body string) *Plugin {
+	path := filepath.Join(dir, PluginPrefix+"Test")
+	err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Plugin{name: "Test", path: path, Config: []byte(`{}`)}
+}
+
+func TestPluginPlanTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d time.Duration) { PluginPlanTimeout = d }(PluginPlanTimeout)
+	PluginPlanTimeout = 50 * time.Millisecond
+
+	p := testPlugin(t, dir, "exec sleep 5")
+	start := time.Now()
+	err = p.Validate()
+	if err == nil || !strings.Contains(err.Error(), "did not plan within 50ms") {
+		t.Errorf("Validate() = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Validate() took %s", d)
+	}
+}
+
+func TestPluginOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := testPlugin(t, dir, `cat >/dev/null; echo '{"Plan": "created 2 things"}'`)
+	var a Actioner = p
+	o, ok := a.(OutputReporter)
+	if !ok {
+		t.Fatal("Plugin is not an OutputReporter")
+	}
+	if err := p.Action(&Ctx{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := o.Output(); got != "created 2 things" {
+		t.Errorf("Output() = %q", got)
+	}
+}
@@ -0,0 +1,262 @@
+package action
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	api "github.com/armon/consul-api"
+)
+
+func init() {
+	DefaultFactories = append(
+		DefaultFactories,
+		func(id string) (Actioner, error) {
+			switch id {
+			case "PreparedQueryDelete":
+				return &PreparedQueryDelete{}, nil
+			case "PreparedQuerySet":
+				return &PreparedQuerySet{}, nil
+			}
+			return nil, UnknownFactoryIDError(id)
+		},
+	)
+}
+
+// preparedQuery is a prepared query as the consul HTTP API has it.
+type preparedQuery struct {
+	ID      string `json:",omitempty"`
+	Name    string
+	Service struct {
+		Service  string
+		Failover struct {
+			NearestN    int      `json:",omitempty"`
+			Datacenters []string `json:",omitempty"`
+		}
+		OnlyPassing bool     `json:",omitempty"`
+		Near        string   `json:",omitempty"`
+		Tags        []string `json:",omitempty"`
+	}
+	DNS struct {
+		TTL string `json:",omitempty"`
+	}
+	Template struct {
+		Type   string `json:",omitempty"`
+		Regexp string `json:",omitempty"`
+	}
+	// raw is the query as it was read, so that the fields that are not
+	// modelled here can be kept when it is updated.
+	raw json.RawMessage
+}
+
+// UnmarshalJSON decodes the query and keeps it as it was read.
+func (p *preparedQuery) UnmarshalJSON(b []byte) error {
+	type plain preparedQuery
+	err := json.Unmarshal(b, (*plain)(p))
+	if err != nil {
+		return err
+	}
+	p.raw = append(json.RawMessage(nil), b...)
+	return nil
+}
+
+// jsonObject returns the object at key in m, adding it when it is missing.
+func jsonObject(m map[string]interface{}, key string) map[string]interface{} {
+	o, ok := m[key].(map[string]interface{})
+	if !ok {
+		o = make(map[string]interface{})
+		m[key] = o
+	}
+	return o
+}
+
+func listPreparedQueries(c *Ctx, q *api.QueryOptions) ([]*preparedQuery, error) {
+	var queries []*preparedQuery
+	err := c.request("GET", "/v1/query", q, nil, nil, &queries)
+	return queries, err
+}
+
+// ListPreparedQueries returns a PreparedQuerySet for each prepared query.
+// Queries without a name that are not templates, such as those made for a
+// session, can only be found by their ID, so they are left out.
+func ListPreparedQueries(c *Ctx, q *api.QueryOptions) ([]*PreparedQuerySet, error) {
+	queries, err := listPreparedQueries(c, q)
+	if err != nil {
+		return nil, err
+	}
+	var sets []*PreparedQuerySet
+	for _, p := range queries {
+		if p.Name == "" && p.Template.Type == "" {
+			continue
+		}
+		sets = append(sets, &PreparedQuerySet{
+			Name:                p.Name,
+			Service:             p.Service.Service,
+			Tags:                p.Service.Tags,
+			OnlyPassing:         p.Service.OnlyPassing,
+			Near:                p.Service.Near,
+			FailoverNearestN:    p.Service.Failover.NearestN,
+			FailoverDatacenters: p.Service.Failover.Datacenters,
+			DNSTTL:              p.DNS.TTL,
+			TemplateType:        p.Template.Type,
+			TemplateRegexp:      p.Template.Regexp,
+		})
+	}
+	return sets, nil
+}
+
+// PreparedQueryDelete action
+type PreparedQueryDelete struct {
+	Name string
+}
+
+// Type returns the type identifier for the actioner
+func (a *PreparedQueryDelete) Type() string {
+	return "PreparedQueryDelete"
+}
+
+// Action performs the prepared query delete action
+func (a *PreparedQueryDelete) Action(c *Ctx) error {
+	q := &api.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+	}
+	queries, err := listPreparedQueries(c, q)
+	if err != nil {
+		return err
+	}
+	for _, p := range queries {
+		if p.Name == a.Name {
+			err = c.request("DELETE", "/v1/query/"+p.ID, nil, nil, nil, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Validate that the action is valid in its current state.
+func (a *PreparedQueryDelete) Validate() error {
+	if a.Name == "" {
+		return errors.New("Name must not be empty.")
+	}
+	return nil
+}
+
+// String representation of the action.
+func (a *PreparedQueryDelete) String() string {
+	return fmt.Sprintf("Prepared Query Delete %q", a.Name)
+}
+
+// PreparedQuerySet action
+//
+// Prepared queries are matched by name, and by whether they are templates.
+// A query with TemplateType "name_prefix_match" is a template that answers
+// for every name that starts with Name, so an empty Name matches any name. When the query already exists only the fields of the action are
+// changed, and everything else, such as its Token, Session, NodeMeta,
+// IgnoreCheckIDs and Failover Targets, is kept.
+type PreparedQuerySet struct {
+	Name                string
+	Service             string
+	Tags                []string `json:",omitempty"`
+	OnlyPassing         bool     `json:",omitempty"`
+	Near                string   `json:",omitempty"`
+	FailoverNearestN    int      `json:",omitempty"`
+	FailoverDatacenters []string `json:",omitempty"`
+	DNSTTL              string   `json:",omitempty"`
+	TemplateType        string   `json:",omitempty"`
+	TemplateRegexp      string   `json:",omitempty"`
+}
+
+// Type returns the type identifier for the actioner
+func (a *PreparedQuerySet) Type() string {
+	return "PreparedQuerySet"
+}
+
+// Action performs the prepared query set action
+func (a *PreparedQuerySet) Action(c *Ctx) error {
+	q := &api.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+	}
+	queries, err := listPreparedQueries(c, q)
+	if err != nil {
+		return err
+	}
+	for _, e := range queries {
+		if a.matches(e) {
+			p, err := a.merge(e.raw)
+			if err != nil {
+				return fmt.Errorf("Unable to read prepared query %q.\n\n%s", e.ID, err)
+			}
+			return c.request("PUT", "/v1/query/"+e.ID, nil, nil, p, nil)
+		}
+	}
+	p, err := a.merge(nil)
+	if err != nil {
+		return err
+	}
+	return c.request("POST", "/v1/query", nil, nil, p, nil)
+}
+
+// matches reports whether the query is the one that the action sets. A
+// template only matches a template, so that a template without a name is
+// not taken for a query without a name.
+func (a *PreparedQuerySet) matches(p *preparedQuery) bool {
+	return p.Name == a.Name && (p.Template.Type != "") == (a.TemplateType != "")
+}
+
+// merge sets the fields of the action on the query raw, which is empty for
+// a new query, and leaves the rest of it as it is.
+func (a *PreparedQuerySet) merge(raw json.RawMessage) (map[string]interface{}, error) {
+	p := make(map[string]interface{})
+	if len(raw) > 0 {
+		d := json.NewDecoder(bytes.NewReader(raw))
+		d.UseNumber()
+		err := d.Decode(&p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p["Name"] = a.Name
+	service := jsonObject(p, "Service")
+	service["Service"] = a.Service
+	service["Tags"] = a.Tags
+	service["OnlyPassing"] = a.OnlyPassing
+	service["Near"] = a.Near
+	failover := jsonObject(service, "Failover")
+	failover["NearestN"] = a.FailoverNearestN
+	failover["Datacenters"] = a.FailoverDatacenters
+	jsonObject(p, "DNS")["TTL"] = a.DNSTTL
+	template := jsonObject(p, "Template")
+	template["Type"] = a.TemplateType
+	template["Regexp"] = a.TemplateRegexp
+	return p, nil
+}
+
+// Validate that the action is valid in its current state.
+func (a *PreparedQuerySet) Validate() error {
+	if a.Name == "" && a.TemplateType == "" {
+		return errors.New("Name must not be empty.")
+	}
+	if a.Service == "" {
+		return errors.New("Service must not be empty.")
+	}
+	if a.TemplateType != "" && a.TemplateType != "name_prefix_match" {
+		return fmt.Errorf("TemplateType %q is not supported.", a.TemplateType)
+	}
+	if a.DNSTTL != "" {
+		if _, err := time.ParseDuration(a.DNSTTL); err != nil {
+			return fmt.Errorf("DNSTTL is not a valid duration.\n\n%s", err)
+		}
+	}
+	return nil
+}
+
+// String representation of the action.
+func (a *PreparedQuerySet) String() string {
+	return fmt.Sprintf("Prepared Query Set %q %q", a.Name, a.Service)
+}
@@ -0,0 +1,152 @@
+package action
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	api "github.com/armon/consul-api"
+)
+
+func TestPreparedQuerySetKeepsUnmanagedFields(t *testing.T) {
+	existing := `[{
+		"ID": "q1",
+		"Name": "web",
+		"Session": "s1",
+		"Token": "secret",
+		"Service": {
+			"Service": "web-old",
+			"Tags": ["old"],
+			"NodeMeta": {"rack": "a"},
+			"IgnoreCheckIDs": ["maint"],
+			"Failover": {"NearestN": 2, "Targets": [{"Peer": "other"}]}
+		},
+		"DNS": {"TTL": "5s"},
+		"RaftIndex": 12345678901234567890
+	}]`
+	var (
+		put  map[string]interface{}
+		body []byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/v1/query":
+			w.Write([]byte(existing))
+		case r.Method == "PUT" && r.URL.Path == "/v1/query/q1":
+			body, _ = ioutil.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &put); err != nil {
+				t.Errorf("bad PUT body %s: %s", body, err)
+			}
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	c, err := NewCtx(&api.Config{Address: u.Host, Scheme: u.Scheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &PreparedQuerySet{Name: "web", Service: "web", OnlyPassing: true}
+	if err := a.Action(&c); err != nil {
+		t.Fatal(err)
+	}
+	if put == nil {
+		t.Fatal("query was not updated")
+	}
+	service := put["Service"].(map[string]interface{})
+	failover := service["Failover"].(map[string]interface{})
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"ID", put["ID"], "q1"},
+		{"Session", put["Session"], "s1"},
+		{"Token", put["Token"], "secret"},
+		{"NodeMeta", service["NodeMeta"], map[string]interface{}{"rack": "a"}},
+		{"IgnoreCheckIDs", service["IgnoreCheckIDs"], []interface{}{"maint"}},
+		{"Failover.Targets", failover["Targets"], []interface{}{map[string]interface{}{"Peer": "other"}}},
+		{"Service", service["Service"], "web"},
+		{"OnlyPassing", service["OnlyPassing"], true},
+		{"Tags", service["Tags"], nil},
+		{"Failover.NearestN", failover["NearestN"], 0.0},
+		{"DNS.TTL", put["DNS"].(map[string]interface{})["TTL"], ""},
+	}
+	if !bytes.Contains(body, []byte(`"RaftIndex":12345678901234567890`)) {
+		t.Errorf("RaftIndex was not kept exactly in %s", body)
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s is %#v, want %#v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestPreparedQuerySetMatches(t *testing.T) {
+	existing := `[
+		{"ID": "s1", "Name": "", "Session": "x", "Service": {"Service": "db"}},
+		{"ID": "q1", "Name": "web", "Service": {"Service": "web"}},
+		{"ID": "t1", "Name": "", "Service": {"Service": "${name.full}"}, "Template": {"Type": "name_prefix_match"}},
+		{"ID": "t2", "Name": "geo", "Service": {"Service": "${name.suffix}"}, "Template": {"Type": "name_prefix_match"}}
+	]`
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Write([]byte(existing))
+			return
+		case "PUT":
+			got = r.URL.Path
+		case "POST":
+			got = "new"
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	c, err := NewCtx(&api.Config{Address: u.Host, Scheme: u.Scheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		a    *PreparedQuerySet
+		want string
+	}{
+		{"named", &PreparedQuerySet{Name: "web", Service: "web"}, "/v1/query/q1"},
+		{"catch all template", &PreparedQuerySet{Service: "${name.full}", TemplateType: "name_prefix_match"}, "/v1/query/t1"},
+		{"named template", &PreparedQuerySet{Name: "geo", Service: "x", TemplateType: "name_prefix_match"}, "/v1/query/t2"},
+		{"query named like a template", &PreparedQuerySet{Name: "geo", Service: "x"}, "new"},
+	}
+	for _, tt := range tests {
+		got = ""
+		if err := tt.a.Action(&c); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: wrote %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	sets, err := ListPreparedQueries(&c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range sets {
+		if err := s.Validate(); err != nil {
+			t.Errorf("exported %s is not valid: %s", s, err)
+		}
+	}
+	if len(sets) != 3 {
+		t.Errorf("exported %d queries, want 3 without the session query", len(sets))
+	}
+}
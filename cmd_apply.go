@@ -1,33 +1,117 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/williambailey/consul-register/action"
 )
 
 var cmdApply = &Command{
-	Usage: "apply [options] file.json",
+	Usage: "apply [options] file.json...",
 	Short: "Apply a list of actions to the consul server.",
 	Long: `
 file.json contains an array of { "Action": "", "Config": {} } items that get applied in order.	
+When more than one file is given their items are applied as a single list, in
+the order of the files.
+
+An item can be given an "ID" and a "DependsOn" list of the IDs of other items.
+Items are applied in order, except that an item is always applied after the
+items that it depends on, which can be in another file. When that changes the
+order, actions are shown with the file and position that they came from.
+
+Actions that fail with a transient error, such as a connection failure, a 5xx
+response or there being no cluster leader, are retried with exponential
+backoff according to the -retry flags. -retry-attempts defaults to 1, so
+nothing is retried unless it is raised. An item can override these with a
+"Retry": { "Attempts": 5, "BaseDelay": "1s", "MaxDelay": "30s", "Jitter": 0.2 }
+field alongside its "Config". Only the fields that are given are overridden,
+so "Jitter": 0 turns jitter off for that item.
+
+Actions can be rewritten before they are applied. -rewrite-kv old=new replaces
+the KV prefix old with new, and may be given more than once with the first
+matching rule being used. -acl-name-template is a template for ACL names where
+{{.Name}} is the original name. -node-prefix is added to external node names.
+The keys and nodes that When conditions check are rewritten in the same way.
+
+With -watch the action file and any files that it references are checked for
+changes every -watch-interval. When they change the actions are loaded again
+and only the actions whose content has changed since the last successful run
+are applied.
+
+-metrics-addr serves Prometheus metrics while watching. A single run exits as
+soon as it is done, so it writes them to -metrics-file instead, which can be
+read by the node exporter textfile collector.
+
+Each action is cancelled if it takes longer than -action-timeout, and the run
+stops if it takes longer than -timeout. On SIGINT or SIGTERM the current action
+is allowed to finish and the remaining actions are not applied. A summary of
+what was and was not applied is shown when a run stops early.
+
+With -parallelism N up to N actions are applied at once. Actions that touch the
+same KV key or prefix, ACL name or node are still applied in the order given,
+so the result is the same as applying them one at a time.
+
+An item can have a "When" condition that is checked against the consul server
+just before the action runs, such as { "KeyExists": "key" }, { "KeyEquals":
+{ "key": "value" } }, { "NodeRegistered": "node" }, { "ServiceRegistered":
+"service" }, { "Datacenter": "dc1" } or { "Env": { "NAME": "value" } }. Every
+part that is given must hold, and { "Not": {} } negates a condition. Actions
+whose condition is false are shown as skipped (condition false), including in
+a dry run, and are counted as skipped rather than applied.
+
+-pre-apply and -post-apply are shell commands that run before and after the
+actions are applied. They get the CONSUL_HTTP_ADDR, CONSUL_HTTP_TOKEN,
+CONSUL_REGISTER_FILE (the files separated by spaces) and CONSUL_REGISTER_ACTIONS
+environment variables, and the
+post-apply hook also gets CONSUL_REGISTER_APPLIED, CONSUL_REGISTER_SKIPPED and
+CONSUL_REGISTER_RESULT, which is success or failure. The run stops if the pre-apply hook fails, and
+the post-apply hook runs even when applying failed. Their output is shown, and
+they are cancelled after -hook-timeout.
 `,
 	Run: runApply,
 }
 
 var (
 	flagApply struct {
-		server string
-		token  string
-		dry    bool
+		server        string
+		token         string
+		dry           bool
+		rewrite       rewriteOptions
+		watch         bool
+		watchInterval time.Duration
+		metricsAddr   string
+		metricsFile   string
+		junit         string
+		retry         retryPolicy
+		timeout       time.Duration
+		actionTimeout time.Duration
+		parallelism   int
+		hooks         hookOptions
 	}
 )
 
 func init() {
 	consulFlag(&cmdApply.Flag, &flagApply.server, &flagApply.token)
 	cmdApply.Flag.BoolVar(&flagApply.dry, "dry", false, "Perform a dry run.")
+	flagApply.rewrite.flag(&cmdApply.Flag)
+	cmdApply.Flag.BoolVar(&flagApply.watch, "watch", false, "Watch the files and apply changes.")
+	cmdApply.Flag.DurationVar(&flagApply.watchInterval, "watch-interval", time.Second, "How often to check for changes when watching.")
+	metricsFlag(&cmdApply.Flag, &flagApply.metricsAddr)
+	metricsFileFlag(&cmdApply.Flag, &flagApply.metricsFile)
+	junitFlag(&cmdApply.Flag, &flagApply.junit)
+	retryFlag(&cmdApply.Flag, &flagApply.retry)
+	timeoutFlag(&cmdApply.Flag, &flagApply.timeout, &flagApply.actionTimeout)
+	parallelismFlag(&cmdApply.Flag, &flagApply.parallelism)
+	flagApply.hooks.flag(&cmdApply.Flag)
 }
 
 func runApply(cmd *Command, args []string) {
@@ -35,42 +119,381 @@ func runApply(cmd *Command, args []string) {
 		err     error
 		ctx     action.Ctx
 		actions action.Actions
+		options actionOptions
 	)
-	if len(args) != 1 {
+	if len(args) < 1 {
 		cmd.UsageExit(nil)
 	}
-	ctx.API, err = parseConsulFlag(flagApply.server, flagApply.token)
+	ctx, err = parseConsulFlag(flagApply.server, flagApply.token)
+	if err != nil {
+		cmd.UsageExit(err)
+	}
+	stop := stopOnSignal()
+	if flagApply.watch {
+		if flagApply.hooks.pre != "" || flagApply.hooks.post != "" {
+			cmd.UsageExit("-pre-apply and -post-apply can not be used with -watch.")
+		}
+		if flagApply.metricsFile != "" {
+			cmd.UsageExit("-metrics-file can not be used with -watch.")
+		}
+		serveMetrics(flagApply.metricsAddr)
+		watchApply(&applier{
+			ctx:           &ctx,
+			retry:         flagApply.retry,
+			actionTimeout: flagApply.actionTimeout,
+			stop:          stop,
+			dry:           flagApply.dry,
+		}, args, flagApply.watchInterval)
+		return
+	}
+	if flagApply.metricsAddr != "" {
+		cmd.UsageExit("-metrics-addr can only be used with -watch, use -metrics-file instead.")
+	}
+	actions, options, err = loadJSONActions(args...)
 	if err != nil {
 		cmd.UsageExit(err)
 	}
-	actions, err = loadJSONActions(args[0])
+	err = flagApply.rewrite.rewrite(actions, options)
 	if err != nil {
 		cmd.UsageExit(err)
 	}
+	if r := flagApply.rewrite.String(); r != "" {
+		printf("!! %s\n", strings.Replace(r, "\n", "\n!! ", -1))
+		emit(event{Event: "rewrite", Message: r})
+	}
+
+	if flagApply.timeout > 0 {
+		c, cancel := context.WithTimeout(ctx.Context, flagApply.timeout)
+		defer cancel()
+		ctx.Context = c
+	}
+	r := &applier{
+		ctx:           &ctx,
+		options:       options,
+		retry:         flagApply.retry,
+		actionTimeout: flagApply.actionTimeout,
+		parallelism:   flagApply.parallelism,
+		stop:          stop,
+		dry:           flagApply.dry,
+	}
+	if !flagApply.dry {
+		err = flagApply.hooks.runPre(&ctx, args, actions)
+		if err != nil {
+			fatal(err, applySummary(actions, make([]outcome, len(actions))))
+		}
+	}
+	done, took, err := r.apply(actions)
+	if !flagApply.dry {
+		herr := flagApply.hooks.runPost(&ctx, args, actions, done, err)
+		if herr != nil && err == nil {
+			err = herr
+		} else if herr != nil {
+			logError(herr)
+		}
+	}
+	if flagApply.junit != "" {
+		werr := junitApply(strings.Join(args, " "), actions, done, took, flagApply.dry, err).write(flagApply.junit)
+		if werr != nil {
+			logError(werr)
+		}
+	}
+	if err == nil {
+		metrics.success()
+	}
+	if flagApply.metricsFile != "" {
+		werr := writeMetricsFile(flagApply.metricsFile)
+		if werr != nil {
+			logError(werr)
+		}
+	}
+	if err != nil {
+		printApplySummary(actions, options, done)
+		fatal(err, applySummary(actions, done))
+	}
+	emit(event{Event: "summary", Summary: applySummary(actions, done)})
+}
+
+// applier applies actions with the settings that are shared by the
+// commands that make changes.
+type applier struct {
+	ctx           *action.Ctx
+	options       actionOptions
+	retry         retryPolicy
+	actionTimeout time.Duration
+	parallelism   int
+	stop          <-chan struct{}
+	dry           bool
+}
+
+// errStopped is returned when a run is stopped by a signal.
+var errStopped = errors.New("Stopped by signal before the remaining actions were applied.")
+
+// stopped reports whether the run has been asked to stop, or has passed its
+// overall deadline.
+func (r *applier) stopped() error {
+	select {
+	case <-r.stop:
+		return errStopped
+	default:
+	}
+	if err := r.ctx.Err(); err != nil {
+		return fmt.Errorf("Stopped before the remaining actions were applied.\n\n%s", err)
+	}
+	return nil
+}
+
+// run performs a single action, retrying it as its policy allows, and
+// records its metrics. It returns how long the action took, or
+// errConditionFalse when the action has a condition that does not hold.
+func (r *applier) run(a action.Actioner) (time.Duration, error) {
+	c := r.ctx.Context
+	if c == nil {
+		c = context.Background()
+	}
+	if r.actionTimeout > 0 {
+		var cancel context.CancelFunc
+		c, cancel = context.WithTimeout(c, r.actionTimeout)
+		defer cancel()
+	}
+	ctx := r.ctx.WithContext(c)
+	ok, err := r.holds(ctx, a)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errConditionFalse
+	}
+	start := time.Now()
+	err = runAction(ctx, a, r.options.get(a).Retry.merge(r.retry))
+	d := time.Since(start)
+	metrics.observeAction(a.Type(), d, err)
+	return d, err
+}
 
-	err = doApply(&ctx, actions)
+// holds reports whether the When condition of the action holds, or true
+// when it has none.
+func (r *applier) holds(ctx *action.Ctx, a action.Actioner) (bool, error) {
+	w := r.options.get(a).When
+	if w == nil {
+		return true, nil
+	}
+	ok, err := w.holds(ctx)
 	if err != nil {
-		log.Fatalln(err)
+		return false, fmt.Errorf("Unable to evaluate the When condition.\n\n%s", err)
+	}
+	return ok, nil
+}
+
+// outcome is what happened to an action in a run of applier.apply.
+type outcome int
+
+const (
+	outcomeNotApplied outcome = iota
+	outcomeApplied
+	outcomeSkipped
+	outcomeFailed
+)
+
+// countOutcome returns the number of actions with the outcome.
+func countOutcome(outcomes []outcome, o outcome) int {
+	n := 0
+	for _, i := range outcomes {
+		if i == o {
+			n++
+		}
+	}
+	return n
+}
+
+// event returns the event for the action at position i, giving where the
+// action was loaded from when it is known.
+func (r *applier) event(name string, i int, a action.Actioner) event {
+	e := actionEvent(name, i+1, a)
+	if opt := r.options.get(a); opt.file != "" {
+		e.Index = opt.index
+		e.File = opt.file
 	}
+	return e
 }
 
-func doApply(ctx *action.Ctx, actions action.Actions) error {
-	var err error
-	if flagApply.dry {
-		fmt.Println("!! Dry run.")
-	}
-	t := len(actions)
-	f := fmt.Sprintf("%%%dd of %d - %%s\n", len(strconv.Itoa(t)), t)
-	for i, a := range actions {
-		fmt.Printf(f, i+1, a)
-		if flagApply.dry {
-			//...
-		} else {
-			err = a.Action(ctx)
+// apply performs the actions, stopping at the first one that fails. Up to
+// parallelism actions are applied at once, but actions that touch the same
+// resource are always applied in the order that they are given. It returns
+// what happened to each of the actions and how long each one that ran took.
+func (r *applier) apply(actions action.Actions) ([]outcome, []time.Duration, error) {
+	var (
+		done    = make([]outcome, len(actions))
+		took    = make([]time.Duration, len(actions))
+		t       = len(actions)
+		f       = fmt.Sprintf("%%%dd of %d - %%s\n", len(strconv.Itoa(t)), t)
+		n       = r.parallelism
+		err     error
+		ready   []int
+		running int
+		inOrder = r.options.inFileOrder(actions)
+	)
+	// describe the action at position i, with where it was loaded from when
+	// the list is not simply the order of a single file.
+	describe := func(i int) string {
+		if inOrder {
+			return actions[i].String()
+		}
+		return fmt.Sprintf("%s (%s)", actions[i], r.options.source(i, actions[i]))
+	}
+	if r.dry {
+		printf("!! Dry run.\n")
+		for i, a := range actions {
+			ok, err := r.holds(r.ctx, a)
 			if err != nil {
-				panic(err)
+				done[i] = outcomeFailed
+				return done, took, r.options.actionError("evaluate", i, a, err)
+			}
+			if !ok {
+				printf(f, i+1, fmt.Sprintf("%s %s", describe(i), errConditionFalse))
+				e := r.event("skipped", i, a)
+				e.Message = errConditionFalse.Error()
+				emit(e)
+				done[i] = outcomeSkipped
+				continue
 			}
+			printf(f, i+1, describe(i))
+			emit(r.event("planned", i, a))
 		}
+		return done, took, nil
 	}
-	return nil
+	if n < 1 {
+		n = 1
+	}
+	deps := actionDeps(actions, r.options)
+	waiting := make([]int, len(actions))
+	dependents := make([][]int, len(actions))
+	for i, d := range deps {
+		waiting[i] = len(d)
+		if len(d) == 0 {
+			ready = append(ready, i)
+		}
+		for _, j := range d {
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+	type result struct {
+		index    int
+		duration time.Duration
+		err      error
+	}
+	results := make(chan result)
+	for {
+		for err == nil && running < n && len(ready) > 0 {
+			if err = r.stopped(); err != nil {
+				break
+			}
+			// Take the ready action that comes first in the list so that
+			// the order is as close to the given order as possible.
+			m := 0
+			for o := range ready {
+				if ready[o] < ready[m] {
+					m = o
+				}
+			}
+			i := ready[m]
+			ready = append(ready[:m], ready[m+1:]...)
+			a := actions[i]
+			printf(f, i+1, describe(i))
+			emit(r.event("started", i, a))
+			running++
+			go func() {
+				d, err := r.run(a)
+				results <- result{i, d, err}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+		res := <-results
+		running--
+		took[res.index] = res.duration
+		a := actions[res.index]
+		switch res.err {
+		case nil:
+			done[res.index] = outcomeApplied
+			e := r.event("applied", res.index, a)
+			e.Duration = res.duration.Seconds()
+			if o, ok := a.(action.OutputReporter); ok && o.Output() != "" {
+				printf("%s\n", strings.TrimRight(o.Output(), "\n"))
+				e.Message = o.Output()
+			}
+			emit(e)
+		case errConditionFalse:
+			done[res.index] = outcomeSkipped
+			printf("!! %s %s\n", r.options.source(res.index, a), errConditionFalse)
+			e := r.event("skipped", res.index, a)
+			e.Message = errConditionFalse.Error()
+			emit(e)
+		default:
+			done[res.index] = outcomeFailed
+			if _, ok := err.(*actionError); !ok {
+				err = r.options.actionError("apply", res.index, a, res.err)
+			}
+			continue
+		}
+		for _, k := range dependents[res.index] {
+			waiting[k]--
+			if waiting[k] == 0 {
+				ready = append(ready, k)
+			}
+		}
+	}
+	return done, took, err
+}
+
+// applySummary returns the summary for a run of applier.apply.
+func applySummary(actions action.Actions, done []outcome) map[string]int {
+	applied := countOutcome(done, outcomeApplied)
+	skipped := countOutcome(done, outcomeSkipped)
+	s := map[string]int{
+		"actions":    len(actions),
+		"applied":    applied,
+		"skipped":    skipped,
+		"failed":     countOutcome(done, outcomeFailed),
+		"notApplied": len(actions) - applied - skipped,
+	}
+	return s
+}
+
+// printApplySummary shows what was and was not applied by a run that
+// stopped early.
+func printApplySummary(actions action.Actions, options actionOptions, done []outcome) {
+	printf("!! Applied %d of %d actions, skipped %d.\n", countOutcome(done, outcomeApplied), len(actions), countOutcome(done, outcomeSkipped))
+	for o, a := range actions {
+		if done[o] == outcomeNotApplied || done[o] == outcomeFailed {
+			printf("!! Not applied %s - %s\n", options.source(o, a), a)
+		}
+	}
+}
+
+func parallelismFlag(flag *flag.FlagSet, n *int) {
+	flag.IntVar(n, "parallelism", 1, "Number of actions to apply at once.")
+}
+
+func timeoutFlag(flag *flag.FlagSet, timeout, actionTimeout *time.Duration) {
+	if timeout != nil {
+		flag.DurationVar(timeout, "timeout", 0, "Stop applying actions after this long, 0 for no limit.")
+	}
+	flag.DurationVar(actionTimeout, "action-timeout", 5*time.Minute, "Cancel an action that takes longer than this, 0 for no limit.")
+}
+
+// stopOnSignal returns a channel that is closed on the first SIGINT or
+// SIGTERM so that the current action can finish. A second signal exits.
+func stopOnSignal() <-chan struct{} {
+	stop := make(chan struct{})
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		logf("Stopping after the current action, signal again to exit now.")
+		close(stop)
+		<-c
+		os.Exit(130)
+	}()
+	return stop
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/armon/consul-api"
+	"github.com/williambailey/consul-register/action"
+)
+
+// kvServer is a fake consul KV store that records the values written to
+// each key in order. Writes to a key in fail get a 403.
+type kvServer struct {
+	sync.Mutex
+	writes  map[string][]string
+	running int
+	most    int
+	fail    string
+}
+
+func (s *kvServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	b, _ := ioutil.ReadAll(r.Body)
+	s.Lock()
+	s.running++
+	if s.running > s.most {
+		s.most = s.running
+	}
+	s.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	s.Lock()
+	defer s.Unlock()
+	s.running--
+	if key == s.fail {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+	s.writes[key] = append(s.writes[key], string(b))
+	w.Write([]byte("true"))
+}
+
+func testApplier(t *testing.T, s *kvServer, parallelism int) (*applier, func()) {
+	srv := httptest.NewServer(s)
+	u, _ := url.Parse(srv.URL)
+	ctx, err := action.NewCtx(&api.Config{Address: u.Host, Scheme: u.Scheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &applier{ctx: &ctx, retry: retryPolicy{Attempts: 1}, parallelism: parallelism}
+	return r, srv.Close
+}
+
+func TestApplyParallelKeepsResourceOrder(t *testing.T) {
+	s := &kvServer{writes: make(map[string][]string)}
+	r, stop := testApplier(t, s, 4)
+	defer stop()
+	actions := action.Actions{
+		kvSet("a", "1"), kvSet("b", "1"), kvSet("c", "1"),
+		kvSet("a", "2"), kvSet("b", "2"),
+		kvSet("a", "3"),
+	}
+	done, took, err := r.apply(actions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countOutcome(done, outcomeApplied); n != len(actions) {
+		t.Errorf("applied %d of %d", n, len(actions))
+	}
+	for o, d := range took {
+		if d < 20*time.Millisecond {
+			t.Errorf("action %d took %s, want the time of its request", o, d)
+		}
+	}
+	want := map[string][]string{"a": {"1", "2", "3"}, "b": {"1", "2"}, "c": {"1"}}
+	if !reflect.DeepEqual(s.writes, want) {
+		t.Errorf("writes %v, want %v", s.writes, want)
+	}
+	if s.most < 2 {
+		t.Errorf("at most %d actions ran at once, want them in parallel", s.most)
+	}
+}
+
+func TestApplyParallelStopsDependents(t *testing.T) {
+	s := &kvServer{writes: make(map[string][]string), fail: "a"}
+	r, stop := testApplier(t, s, 4)
+	defer stop()
+	actions := action.Actions{kvSet("a", "1"), kvSet("b", "1"), kvSet("a", "2")}
+	done, _, err := r.apply(actions)
+	if err == nil {
+		t.Fatal("apply did not fail")
+	}
+	want := []outcome{outcomeFailed, outcomeApplied, outcomeNotApplied}
+	if !reflect.DeepEqual(done, want) {
+		t.Errorf("outcomes %v, want %v", done, want)
+	}
+	if len(s.writes["a"]) != 0 {
+		t.Errorf("a was written after the first write to it failed: %v", s.writes["a"])
+	}
+}
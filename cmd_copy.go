@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+var cmdCopy = &Command{
+	Usage: "copy [options]",
+	Short: "Copy consul configuration between servers.",
+	Long: `
+    Configuration is exported from the -from server and applied directly
+    to the -to server. The same scope options as export are supported, and
+    ACLs keep their IDs.
+
+    The same rewrite options as apply are supported.
+    `,
+	Run: runCopy,
+}
+
+var (
+	flagCopy struct {
+		fromServer    string
+		fromToken     string
+		toServer      string
+		toToken       string
+		dry           bool
+		acl           bool
+		externalNode  bool
+		kv            bool
+		rewrite       rewriteOptions
+		options       exportOptions
+		retry         retryPolicy
+		timeout       time.Duration
+		actionTimeout time.Duration
+		parallelism   int
+	}
+)
+
+func init() {
+	cmdCopy.Flag.StringVar(&flagCopy.fromServer, "from", "http://127.0.0.1:8500", "Consul server address to copy from")
+	cmdCopy.Flag.StringVar(&flagCopy.fromToken, "from-token", "", "Consul token for the server to copy from")
+	cmdCopy.Flag.StringVar(&flagCopy.toServer, "to", "", "Consul server address to copy to")
+	cmdCopy.Flag.StringVar(&flagCopy.toToken, "to-token", "", "Consul token for the server to copy to")
+	cmdCopy.Flag.BoolVar(&flagCopy.dry, "dry", false, "Perform a dry run.")
+	cmdCopy.Flag.BoolVar(&flagCopy.acl, "acl", false, "Include ACL.")
+	cmdCopy.Flag.BoolVar(&flagCopy.externalNode, "externalNode", false, "Include External Nodes.")
+	cmdCopy.Flag.BoolVar(&flagCopy.kv, "kv", false, "Include KV.")
+	flagCopy.rewrite.flag(&cmdCopy.Flag)
+	flagCopy.options.flag(&cmdCopy.Flag)
+	flagCopy.options.aclID = true
+	retryFlag(&cmdCopy.Flag, &flagCopy.retry)
+	timeoutFlag(&cmdCopy.Flag, &flagCopy.timeout, &flagCopy.actionTimeout)
+	parallelismFlag(&cmdCopy.Flag, &flagCopy.parallelism)
+}
+
+func runCopy(cmd *Command, args []string) {
+	var (
+		err     error
+		from    action.Ctx
+		to      action.Ctx
+		actions = make(action.Actions, 0)
+	)
+	if len(args) != 0 {
+		cmd.UsageExit(nil)
+	}
+	if flagCopy.toServer == "" {
+		cmd.UsageExit("The -to flag is required.")
+	}
+	from, err = parseConsulFlag(flagCopy.fromServer, flagCopy.fromToken)
+	if err != nil {
+		cmd.UsageExit(err)
+	}
+	to, err = parseConsulFlag(flagCopy.toServer, flagCopy.toToken)
+	if err != nil {
+		cmd.UsageExit(err)
+	}
+	err = flagCopy.options.validate()
+	if err != nil {
+		cmd.UsageExit(err)
+	}
+	if flagCopy.acl {
+		actions, err = exportACL(&from, actions, &flagCopy.options)
+		if err != nil {
+			fatal(err, nil)
+		}
+	}
+	if flagCopy.externalNode {
+		actions, err = exportExternalNode(&from, actions, &flagCopy.options)
+		if err != nil {
+			fatal(err, nil)
+		}
+	}
+	if flagCopy.kv {
+		actions, err = exportKV(&from, actions, &flagCopy.options)
+		if err != nil {
+			fatal(err, nil)
+		}
+	}
+	sortActions(actions)
+	err = flagCopy.rewrite.rewrite(actions, nil)
+	if err != nil {
+		cmd.UsageExit(err)
+	}
+
+	if flagCopy.timeout > 0 {
+		c, cancel := context.WithTimeout(to.Context, flagCopy.timeout)
+		defer cancel()
+		to.Context = c
+	}
+	r := &applier{
+		ctx:           &to,
+		retry:         flagCopy.retry,
+		actionTimeout: flagCopy.actionTimeout,
+		parallelism:   flagCopy.parallelism,
+		stop:          stopOnSignal(),
+		dry:           flagCopy.dry,
+	}
+	done, _, err := r.apply(actions)
+	if err != nil {
+		printApplySummary(actions, nil, done)
+		fatal(err, applySummary(actions, done))
+	}
+	emit(event{Event: "summary", Summary: applySummary(actions, done)})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+var cmdDiff = &Command{
+	Usage: "diff [options] file.json...",
+	Short: "Compare a list of actions with the consul server.",
+	Long: `
+    The actions in the files are compared with the configuration exported
+    from the consul server and the differences are sent to STDOUT. Lines
+    start with "+" for items that would be added, "-" for items that would
+    be removed and "~" for items that would be changed by apply.
+
+    Only the KV, ACLs, nodes, prepared queries and config entries that the
+    actions manage are compared. Fields of a config entry that the action
+    does not give only count as different when they are not empty. KV is
+    read from the longest prefix shared by the actions unless -kv-prefix is
+    given. Actions with a When condition that does not hold are left out.
+    The exit code is 2 when there are differences, and 1 when the files
+    can not be loaded or the comparison fails.
+    `,
+	Run: runDiff,
+}
+
+var (
+	flagDiff struct {
+		server  string
+		token   string
+		options exportOptions
+	}
+)
+
+func init() {
+	consulFlag(&cmdDiff.Flag, &flagDiff.server, &flagDiff.token)
+	flagDiff.options.flag(&cmdDiff.Flag)
+}
+
+func runDiff(cmd *Command, args []string) {
+	var (
+		err     error
+		ctx     action.Ctx
+		actions action.Actions
+		options actionOptions
+	)
+	if len(args) < 1 {
+		cmd.UsageExit(nil)
+	}
+	// Exit code 2 means that there are differences, so errors exit with 1
+	// rather than through UsageExit.
+	ctx, err = parseConsulFlag(flagDiff.server, flagDiff.token)
+	if err != nil {
+		fatal(err, nil)
+	}
+	err = flagDiff.options.validate()
+	if err != nil {
+		fatal(err, nil)
+	}
+	actions, options, err = loadJSONActions(args...)
+	if err != nil {
+		fatal(err, nil)
+	}
+
+	changes, err := doDiff(&ctx, actions, options, flagDiff.options)
+	if err != nil {
+		fatal(err, nil)
+	}
+	for _, c := range changes {
+		printf("%s\n", c)
+		emit(changeToEvent(c))
+	}
+	emit(event{Event: "summary", Summary: map[string]int{"changes": len(changes)}})
+	if len(changes) == 0 {
+		printf("No differences.\n")
+		return
+	}
+	os.Exit(2)
+}
+
+func doDiff(ctx *action.Ctx, actions action.Actions, options actionOptions, o exportOptions) ([]change, error) {
+	actions, err := activeActions(ctx, actions, options)
+	if err != nil {
+		return nil, err
+	}
+	desired := newState()
+	err = desired.apply(actions)
+	if err != nil {
+		return nil, err
+	}
+	live, err := exportState(ctx, desired, o)
+	if err != nil {
+		return nil, err
+	}
+	return compare(desired, live), nil
+}
+
+// exportState exports the live state for the items that the desired state
+// manages.
+func exportState(ctx *action.Ctx, desired *state, o exportOptions) (*state, error) {
+	var (
+		err     error
+		actions action.Actions
+	)
+	if len(desired.acl) > 0 {
+		actions, err = exportACL(ctx, actions, &o)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(desired.nodes) > 0 {
+		actions, err = exportExternalNode(ctx, actions, &o)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(desired.queries) > 0 {
+		actions, err = exportPreparedQueries(ctx, actions, &o)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(desired.configEntries) > 0 {
+		actions, err = exportConfigEntries(ctx, actions, desired.configKinds(), &o)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(desired.kv) > 0 || len(desired.kvPrefixes) > 0 {
+		if o.kv.prefix == "" {
+			o.kv.prefix = desired.kvPrefix()
+		}
+		actions, err = exportKV(ctx, actions, &o)
+		if err != nil {
+			return nil, err
+		}
+	}
+	live := newState()
+	err = live.apply(actions)
+	if err != nil {
+		return nil, err
+	}
+	return live, nil
+}
+
+// changeToEvent returns the event for a change.
+func changeToEvent(c change) event {
+	e := event{
+		Event: "change",
+		Change: &changeEvent{
+			Op:   c.op,
+			Kind: c.kind,
+			Name: c.name,
+			From: c.from,
+			To:   c.to,
+		},
+	}
+	if c.action != nil {
+		e.Type = c.action.Type()
+		e.Action = c.action.String()
+	}
+	return e
+}
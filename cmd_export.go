@@ -1,8 +1,21 @@
 package main
 
 import (
-	"log"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
 
 	api "github.com/armon/consul-api"
 	"github.com/williambailey/consul-register/action"
@@ -13,6 +26,33 @@ var cmdExport = &Command{
 	Short: "Export consul configuration.",
 	Long: `
     Configuration is exported in JSON format and sent directly to STDOUT.
+
+    When -out-dir is given the KV store is written to that directory as a
+    tree with one file per key under -kv-prefix, which is taken to end in
+    a "/", and a KVSetTree action that loads it back is exported in place
+    of the individual KVSet actions. Flags that are
+    not zero are written to a sidecar file with a ".flags" suffix.
+
+    KV export can be scoped with -kv-prefix, -include and -exclude. The
+    include and exclude patterns may be given more than once and are globs
+    that match a key or any of its parent paths, or regular expressions
+    when prefixed with "re:". Keys that are locked by a session are skipped
+    unless -kv-locked is given.
+
+    Reads use the -consistency mode, and node details are fetched using up
+    to -workers concurrent requests. The export is retried if the catalog
+    changes while it is being read.
+
+    When -kv-document is given the keys under that prefix are folded into
+    a nested document and exported as a KVSetDocument action.
+
+    -prepared-queries exports a PreparedQuerySet action for each prepared
+    query, which are matched by name when they are applied.
+
+    -config-entries exports a ConfigEntrySet action for each config entry,
+    and -config-entries=kind exports only the entries of that kind. Kinds
+    that the server does not support are skipped with a warning unless they
+    were asked for.
     `,
 	Run: runExport,
 }
@@ -24,6 +64,11 @@ var (
 		acl          bool
 		externalNode bool
 		kv           bool
+		kvOutDir     string
+		kvDocument   string
+		queries      bool
+		entries      configEntriesFlag
+		options      exportOptions
 	}
 )
 
@@ -32,6 +77,12 @@ func init() {
 	cmdExport.Flag.BoolVar(&flagExport.acl, "acl", false, "Include ACL.")
 	cmdExport.Flag.BoolVar(&flagExport.externalNode, "externalNode", false, "Include External Nodes.")
 	cmdExport.Flag.BoolVar(&flagExport.kv, "kv", false, "Include KV.")
+	cmdExport.Flag.StringVar(&flagExport.kvOutDir, "out-dir", "", "Write KV to a directory tree.")
+	cmdExport.Flag.StringVar(&flagExport.kvDocument, "kv-document", "", "Export the KV prefix as a document.")
+	cmdExport.Flag.BoolVar(&flagExport.options.aclID, "acl-id", false, "Include ACL IDs, which are the tokens.")
+	cmdExport.Flag.BoolVar(&flagExport.queries, "prepared-queries", false, "Include prepared queries.")
+	cmdExport.Flag.Var(&flagExport.entries, "config-entries", "Include config entries, or only those of the kind given with -config-entries=kind.")
+	flagExport.options.flag(&cmdExport.Flag)
 }
 
 func runExport(cmd *Command, args []string) {
@@ -43,38 +94,131 @@ func runExport(cmd *Command, args []string) {
 	if len(args) != 0 {
 		cmd.UsageExit(nil)
 	}
-	ctx.API, err = parseConsulFlag(flagExport.server, flagExport.token)
+	ctx, err = parseConsulFlag(flagExport.server, flagExport.token)
+	if err != nil {
+		cmd.UsageExit(err)
+	}
+	err = flagExport.options.validate()
+	if err != nil {
+		cmd.UsageExit(err)
+	}
+	err = flagExport.entries.validate()
 	if err != nil {
 		cmd.UsageExit(err)
 	}
 	if flagExport.acl {
-		actions, err = exportACL(&ctx, actions)
+		actions, err = exportACL(&ctx, actions, &flagExport.options)
 		if err != nil {
-			log.Fatalln(err)
+			fatal(err, nil)
 		}
 	}
 	if flagExport.externalNode {
-		actions, err = exportExternalNode(&ctx, actions)
+		actions, err = exportExternalNode(&ctx, actions, &flagExport.options)
+		if err != nil {
+			fatal(err, nil)
+		}
+	}
+	if flagExport.kv && flagExport.kvOutDir != "" {
+		var (
+			kvs  action.Actions
+			tree action.Actioner
+		)
+		// The tree holds the keys under the prefix as a directory.
+		flagExport.options.kv.prefix = treePrefix(flagExport.options.kv.prefix)
+		kvs, err = exportKV(&ctx, kvs, &flagExport.options)
+		if err != nil {
+			fatal(err, nil)
+		}
+		tree, err = exportKVTree(flagExport.kvOutDir, flagExport.options.kv.prefix, kvs)
+		if err != nil {
+			fatal(err, nil)
+		}
+		actions = append(actions, tree)
+	} else if flagExport.kv {
+		actions, err = exportKV(&ctx, actions, &flagExport.options)
+		if err != nil {
+			fatal(err, nil)
+		}
+	}
+	if flagExport.kvDocument != "" {
+		actions, err = exportKVDocument(&ctx, actions, flagExport.kvDocument, &flagExport.options)
+		if err != nil {
+			fatal(err, nil)
+		}
+	}
+	if flagExport.queries {
+		actions, err = exportPreparedQueries(&ctx, actions, &flagExport.options)
 		if err != nil {
-			log.Fatalln(err)
+			fatal(err, nil)
 		}
 	}
-	if flagExport.kv {
-		actions, err = exportKV(&ctx, actions)
+	if flagExport.entries.enabled {
+		actions, err = exportConfigEntries(&ctx, actions, flagExport.entries.kinds, &flagExport.options)
 		if err != nil {
-			log.Fatalln(err)
+			fatal(err, nil)
 		}
 	}
+	sortActions(actions)
+	if jsonOutput {
+		for o, a := range actions {
+			e := actionEvent("exported", o+1, a)
+			e.Config = a
+			emit(e)
+		}
+		emit(event{Event: "summary", Summary: map[string]int{"actions": len(actions)}})
+		return
+	}
 	out, err := saveJSONActions(actions)
 	if err != nil {
-		log.Fatalln(err)
+		fatal(err, nil)
 	}
 	out.WriteTo(os.Stdout)
 }
 
-func exportACL(ctx *action.Ctx, a action.Actions) (action.Actions, error) {
+// exportOptions controls how configuration is read from consul.
+type exportOptions struct {
+	consistency string
+	workers     int
+	aclID       bool
+	kv          kvScope
+}
+
+func (o *exportOptions) flag(flag *flag.FlagSet) {
+	flag.StringVar(&o.consistency, "consistency", "default", "Read consistency mode, one of default, consistent or stale.")
+	flag.IntVar(&o.workers, "workers", 8, "Number of concurrent requests used to read node details.")
+	o.kv.flag(flag)
+}
+
+func (o *exportOptions) validate() error {
+	if _, err := o.queryOptions(); err != nil {
+		return err
+	}
+	if o.workers < 1 {
+		return errors.New("Invalid workers flag, must be at least 1.")
+	}
+	return nil
+}
+
+// queryOptions returns new query options for the consistency mode.
+func (o *exportOptions) queryOptions() (*api.QueryOptions, error) {
+	switch o.consistency {
+	case "", "default":
+		return &api.QueryOptions{}, nil
+	case "consistent":
+		return &api.QueryOptions{RequireConsistent: true}, nil
+	case "stale":
+		return &api.QueryOptions{AllowStale: true}, nil
+	}
+	return nil, fmt.Errorf("Invalid consistency flag %q, must be one of default, consistent or stale.", o.consistency)
+}
+
+func exportACL(ctx *action.Ctx, a action.Actions, o *exportOptions) (action.Actions, error) {
 	var err error
-	acls, _, err := ctx.API.ACL().List(nil)
+	q, err := o.queryOptions()
+	if err != nil {
+		return nil, err
+	}
+	acls, _, err := ctx.API.ACL().List(q)
 	if err != nil {
 		return nil, err
 	}
@@ -82,30 +226,203 @@ func exportACL(ctx *action.Ctx, a action.Actions) (action.Actions, error) {
 		if acl.Type == api.ACLManagementType {
 			continue
 		}
-		a = append(a, &action.ACLSet{
+		set := &action.ACLSet{
 			Name:  acl.Name,
 			Rules: acl.Rules,
-		})
+		}
+		if o.aclID {
+			set.ID = acl.ID
+		}
+		a = append(a, set)
 	}
 	return a, nil
 }
 
-func exportExternalNode(ctx *action.Ctx, a action.Actions) (action.Actions, error) {
-	var err error
-	q := &api.QueryOptions{
-		AllowStale:        false,
-		RequireConsistent: true,
+func exportPreparedQueries(ctx *action.Ctx, a action.Actions, o *exportOptions) (action.Actions, error) {
+	q, err := o.queryOptions()
+	if err != nil {
+		return nil, err
 	}
-	nodes, _, err := ctx.API.Catalog().Nodes(q)
+	queries, err := action.ListPreparedQueries(ctx, q)
 	if err != nil {
 		return nil, err
 	}
-	for _, n := range nodes {
-		exportNode := true
-		node, _, err := ctx.API.Catalog().Node(n.Node, q)
+	for _, p := range queries {
+		a = append(a, p)
+	}
+	return a, nil
+}
+
+func exportConfigEntries(ctx *action.Ctx, a action.Actions, kinds []string, o *exportOptions) (action.Actions, error) {
+	q, err := o.queryOptions()
+	if err != nil {
+		return nil, err
+	}
+	all := len(kinds) == 0
+	if all {
+		kinds = action.ConfigEntryKinds
+	}
+	for _, kind := range kinds {
+		entries, err := action.ListConfigEntries(ctx, kind, q)
+		if err != nil && all && unsupportedKind.MatchString(err.Error()) {
+			// Older servers do not know every kind, which should not stop
+			// the kinds that they do know from being exported.
+			msg := fmt.Sprintf("Skipping config entries of kind %q, which the server does not support.", kind)
+			logf("%s", msg)
+			emit(event{Event: "warning", Message: msg, Error: err.Error()})
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
+		for _, e := range entries {
+			a = append(a, e)
+		}
+	}
+	return a, nil
+}
+
+// unsupportedKind matches the errors that consul gives for a kind of config
+// entry that it does not know, or when it has no config entries at all.
+var unsupportedKind = regexp.MustCompile(`Unexpected response code: (400|404)|(?i)invalid config entry kind`)
+
+// configEntriesFlag is set to export every kind of config entry, or to a
+// kind to export only that kind. It may be given more than once.
+type configEntriesFlag struct {
+	enabled bool
+	kinds   []string
+}
+
+func (f *configEntriesFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (f *configEntriesFlag) String() string {
+	return strings.Join(f.kinds, ", ")
+}
+
+func (f *configEntriesFlag) Set(v string) error {
+	switch v {
+	case "true":
+		f.enabled = true
+	case "false":
+		f.enabled = false
+	default:
+		f.enabled = true
+		f.kinds = append(f.kinds, v)
+	}
+	return nil
+}
+
+func (f *configEntriesFlag) validate() error {
+	for _, v := range f.kinds {
+		ok := false
+		for _, k := range action.ConfigEntryKinds {
+			ok = ok || k == v
+		}
+		if !ok {
+			return fmt.Errorf("Invalid config-entries flag, unknown kind %q.", v)
+		}
+	}
+	return nil
+}
+
+// exportCatalogRetries is the number of times that the catalog is read
+// before giving up when it keeps changing during the export.
+const exportCatalogRetries = 3
+
+func exportExternalNode(ctx *action.Ctx, a action.Actions, o *exportOptions) (action.Actions, error) {
+	var err error
+	for i := 0; i < exportCatalogRetries; i++ {
+		var en action.Actions
+		en, err = exportExternalNodeSnapshot(ctx, o)
+		if err == nil {
+			return append(a, en...), nil
+		}
+		if _, ok := err.(catalogChangedError); !ok {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// catalogChangedError is returned when the catalog index moves while the
+// nodes are being read, meaning that the export is not a single snapshot.
+type catalogChangedError struct {
+	from, to uint64
+}
+
+func (e catalogChangedError) Error() string {
+	return fmt.Sprintf("Catalog changed during export, index moved from %d to %d.", e.from, e.to)
+}
+
+func exportExternalNodeSnapshot(ctx *action.Ctx, o *exportOptions) (action.Actions, error) {
+	q, err := o.queryOptions()
+	if err != nil {
+		return nil, err
+	}
+	nodes, meta, err := ctx.API.Catalog().Nodes(q)
+	if err != nil {
+		return nil, err
+	}
+	index := meta.LastIndex
+	_, meta, err = ctx.API.Catalog().Services(q)
+	if err != nil {
+		return nil, err
+	}
+	servicesIndex := meta.LastIndex
+	type result struct {
+		node *api.CatalogNode
+		err  error
+	}
+	var (
+		results = make([]result, len(nodes))
+		jobs    = make(chan int)
+		wg      sync.WaitGroup
+	)
+	for w := 0; w < o.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				node, _, err := ctx.API.Catalog().Node(nodes[i].Node, q)
+				results[i] = result{node, err}
+			}
+		}()
+	}
+	for i := range nodes {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	// The index of each node also moves with its checks, so compare the
+	// node and service list indexes from before and after instead.
+	_, meta, err = ctx.API.Catalog().Nodes(q)
+	if err != nil {
+		return nil, err
+	}
+	if meta.LastIndex != index {
+		return nil, catalogChangedError{index, meta.LastIndex}
+	}
+	_, meta, err = ctx.API.Catalog().Services(q)
+	if err != nil {
+		return nil, err
+	}
+	if meta.LastIndex != servicesIndex {
+		return nil, catalogChangedError{servicesIndex, meta.LastIndex}
+	}
+
+	var a action.Actions
+	for _, r := range results {
+		if r.err != nil {
+			return nil, r.err
+		}
+		node := r.node
+		if node == nil || node.Node == nil {
+			continue
+		}
+		exportNode := true
 		for _, s := range node.Services {
 			if s.ID == "consul" {
 				exportNode = false
@@ -122,30 +439,336 @@ func exportExternalNode(ctx *action.Ctx, a action.Actions) (action.Actions, erro
 		o := -1
 		for _, s := range node.Services {
 			o++
+			tags := append([]string(nil), s.Tags...)
+			sort.Strings(tags)
 			en.Services[o] = &action.ExternalNodeService{
 				ID:      s.ID,
 				Service: s.Service,
-				Tags:    s.Tags,
+				Tags:    tags,
 				Port:    s.Port,
 			}
 		}
+		sort.Sort(servicesByID(en.Services))
 		a = append(a, en)
 	}
 	return a, nil
 }
 
-func exportKV(ctx *action.Ctx, a action.Actions) (action.Actions, error) {
+type servicesByID []*action.ExternalNodeService
+
+func (s servicesByID) Len() int           { return len(s) }
+func (s servicesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s servicesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// sortActions puts exported actions into a canonical order, by type and then
+// by key, name or node, so that exports of an unchanged cluster are identical.
+func sortActions(a action.Actions) {
+	sort.Stable(actionsByKey(a))
+}
+
+type actionsByKey action.Actions
+
+func (a actionsByKey) Len() int      { return len(a) }
+func (a actionsByKey) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a actionsByKey) Less(i, j int) bool {
+	if a[i].Type() != a[j].Type() {
+		return a[i].Type() < a[j].Type()
+	}
+	return exportSortKey(a[i]) < exportSortKey(a[j])
+}
+
+// exportSortKey returns the identifier of the item that an exported action
+// manages.
+func exportSortKey(a action.Actioner) string {
+	switch a := a.(type) {
+	case *action.ACLSet:
+		return a.Name
+	case *action.ExternalNodeRegister:
+		return a.Node
+	case *action.KVSet:
+		return a.Key
+	case *action.KVSetTree:
+		return a.Prefix
+	case *action.KVSetDocument:
+		return a.Prefix
+	case *action.PreparedQuerySet:
+		return a.Name
+	case *action.ConfigEntrySet:
+		return a.Kind + "/" + a.Name
+	}
+	return a.String()
+}
+
+// kvScope limits the keys that are exported.
+type kvScope struct {
+	prefix  string
+	include stringsFlag
+	exclude stringsFlag
+	maxSize int
+	locked  bool
+}
+
+func (s *kvScope) flag(flag *flag.FlagSet) {
+	flag.StringVar(&s.prefix, "kv-prefix", "", "Only include KV under this prefix.")
+	flag.Var(&s.include, "include", "Only include KV matching this pattern.")
+	flag.Var(&s.exclude, "exclude", "Exclude KV matching this pattern.")
+	flag.IntVar(&s.maxSize, "kv-max-size", 0, "Exclude KV values larger than this many bytes.")
+	flag.BoolVar(&s.locked, "kv-locked", false, "Include KV that is locked by a session.")
+}
+
+// match reports whether the key value pair is in scope.
+func (s *kvScope) match(kv *api.KVPair) (bool, error) {
+	if !strings.HasPrefix(kv.Key, s.prefix) {
+		return false, nil
+	}
+	if kv.Session != "" && !s.locked {
+		return false, nil
+	}
+	if s.maxSize > 0 && len(kv.Value) > s.maxSize {
+		logf("Skipping %q, value is %d bytes.", kv.Key, len(kv.Value))
+		return false, nil
+	}
+	if len(s.include) > 0 {
+		ok, err := matchKVPattern(s.include, kv.Key)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	ok, err := matchKVPattern(s.exclude, kv.Key)
+	return !ok && err == nil, err
+}
+
+// matchKVPattern reports whether the key matches any of the patterns. Globs
+// match the key or any of its parent paths, while patterns prefixed with
+// "re:" are regular expressions matched against the key.
+func matchKVPattern(patterns []string, key string) (bool, error) {
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "re:") {
+			re, err := regexp.Compile(p[3:])
+			if err != nil {
+				return false, fmt.Errorf("Invalid pattern %q.\n\n%s", p, err)
+			}
+			if re.MatchString(key) {
+				return true, nil
+			}
+			continue
+		}
+		k := strings.TrimSuffix(key, "/")
+		for {
+			ok, err := path.Match(p, k)
+			if err != nil {
+				return false, fmt.Errorf("Invalid pattern %q.\n\n%s", p, err)
+			}
+			if ok {
+				return true, nil
+			}
+			i := strings.LastIndex(k, "/")
+			if i < 0 {
+				break
+			}
+			k = k[:i]
+		}
+	}
+	return false, nil
+}
+
+func exportKV(ctx *action.Ctx, a action.Actions, o *exportOptions) (action.Actions, error) {
 	var err error
-	kvs, _, err := ctx.API.KV().List("", nil)
+	s := &o.kv
+	q, err := o.queryOptions()
+	if err != nil {
+		return nil, err
+	}
+	kvs, _, err := ctx.API.KV().List(s.prefix, q)
 	if err != nil {
 		return nil, err
 	}
 	for _, kv := range kvs {
+		ok, err := s.match(kv)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		v := action.KVValue{}
+		if utf8.Valid(kv.Value) {
+			v.Value = string(kv.Value)
+		} else {
+			v.ValueBase64 = base64.StdEncoding.EncodeToString(kv.Value)
+		}
 		a = append(a, &action.KVSet{
-			Key:   kv.Key,
-			Flags: kv.Flags,
-			Value: string(kv.Value),
+			Key:     kv.Key,
+			Flags:   kv.Flags,
+			KVValue: v,
 		})
 	}
 	return a, nil
 }
+
+func exportKVDocument(ctx *action.Ctx, a action.Actions, prefix string, o *exportOptions) (action.Actions, error) {
+	var err error
+	s := &o.kv
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	q, err := o.queryOptions()
+	if err != nil {
+		return nil, err
+	}
+	kvs, _, err := ctx.API.KV().List(prefix, q)
+	if err != nil {
+		return nil, err
+	}
+	doc := make(map[string]interface{})
+	for _, kv := range kvs {
+		ok, err := s.match(kv)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if !utf8.Valid(kv.Value) {
+			return nil, fmt.Errorf("Unable to export key %q as a document, value is not valid UTF-8.", kv.Key)
+		}
+		m := doc
+		parts := strings.Split(strings.TrimPrefix(kv.Key, prefix), "/")
+		for o, p := range parts {
+			if o == len(parts)-1 {
+				if p == "" {
+					break
+				}
+				if _, ok := m[p]; ok {
+					return nil, fmt.Errorf("Unable to export key %q as a document, it is also a prefix.", kv.Key)
+				}
+				m[p] = string(kv.Value)
+				break
+			}
+			switch c := m[p].(type) {
+			case map[string]interface{}:
+				m = c
+			case nil:
+				n := make(map[string]interface{})
+				m[p] = n
+				m = n
+			default:
+				return nil, fmt.Errorf("Unable to export key %q as a document, its parent is also a key.", kv.Key)
+			}
+		}
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	a = append(a, &action.KVSetDocument{
+		Prefix:   prefix,
+		Document: b,
+	})
+	return a, nil
+}
+
+// treePrefix returns the prefix that a KV tree is saved under, which ends in
+// a "/" so that the keys are the paths of the files.
+func treePrefix(prefix string) string {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// exportKVTree saves the KVSet actions to dir and returns the KVSetTree
+// action that loads them back.
+func exportKVTree(dir, prefix string, a action.Actions) (action.Actioner, error) {
+	prefix = treePrefix(prefix)
+	err := saveKVTree(dir, prefix, a)
+	if err != nil {
+		return nil, err
+	}
+	return &action.KVSetTree{Prefix: prefix, Dir: dir}, nil
+}
+
+// saveKVTree writes the KVSet actions under prefix to dir with one file per
+// key. Every key is checked before anything is written, so a key that can
+// not be saved does not leave a partial tree behind.
+func saveKVTree(dir, prefix string, a action.Actions) error {
+	type kvFile struct {
+		kv   *action.KVSet
+		file string
+	}
+	var (
+		files []kvFile
+		keys  = make(map[string]bool)
+		root  = filepath.Clean(dir)
+	)
+	for _, i := range a {
+		kv, ok := i.(*action.KVSet)
+		if !ok {
+			continue
+		}
+		if !strings.HasPrefix(kv.Key, prefix) {
+			return fmt.Errorf("Unable to save key %q, it is not under the prefix %q.", kv.Key, prefix)
+		}
+		if strings.HasSuffix(kv.Key, action.KVFlagsSuffix) {
+			return fmt.Errorf("Unable to save key %q, the %q suffix is reserved.", kv.Key, action.KVFlagsSuffix)
+		}
+		rel := strings.TrimSuffix(strings.TrimPrefix(kv.Key, prefix), "/")
+		file := filepath.Join(root, filepath.FromSlash(rel))
+		if file != root && !strings.HasPrefix(file, root+string(filepath.Separator)) {
+			return fmt.Errorf("Unable to save key %q, it is outside of %q.", kv.Key, dir)
+		}
+		if file == root && !strings.HasSuffix(kv.Key, "/") {
+			return fmt.Errorf("Unable to save key %q, it is the prefix itself.", kv.Key)
+		}
+		if file != root && filepath.ToSlash(strings.TrimPrefix(file, root+string(filepath.Separator))) != rel {
+			// Such as "a//b" or "a/./b", which would load back as another key.
+			return fmt.Errorf("Unable to save key %q, it is not a clean path.", kv.Key)
+		}
+		files = append(files, kvFile{kv, file})
+		keys[kv.Key] = true
+	}
+	for _, f := range files {
+		k := f.kv.Key
+		for i := strings.Index(k, "/"); i >= 0; i = nextSlash(k, i) {
+			if keys[k[:i]] {
+				return fmt.Errorf("Unable to save key %q, the key %q would have to be both a file and a directory.", k, k[:i])
+			}
+		}
+	}
+
+	for _, f := range files {
+		kv, file := f.kv, f.file
+		if strings.HasSuffix(kv.Key, "/") {
+			if err := os.MkdirAll(file, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		v, err := kv.Bytes()
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(file, v, 0644); err != nil {
+			return err
+		}
+		if kv.Flags != 0 {
+			f := strconv.FormatUint(kv.Flags, 10) + "\n"
+			if err = ioutil.WriteFile(file+action.KVFlagsSuffix, []byte(f), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nextSlash returns the index of the next "/" in s after i, or -1.
+func nextSlash(s string, i int) int {
+	n := strings.Index(s[i+1:], "/")
+	if n < 0 {
+		return -1
+	}
+	return i + 1 + n
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	api "github.com/armon/consul-api"
+	"github.com/williambailey/consul-register/action"
+)
+
+func TestSaveKVTreeRefusesKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		keys   []string
+	}{
+		{"traversal", "app/", []string{"app/ok", "app/../../../etc/cron.d/x"}},
+		{"inner traversal", "app/", []string{"app/a/../b"}},
+		{"empty segment", "app/", []string{"app/a//b"}},
+		{"file and directory", "app/", []string{"app/a", "app/a/b"}},
+		{"directory then file", "app/", []string{"app/a/b", "app/a"}},
+		{"outside prefix", "app/", []string{"other/a"}},
+		{"reserved suffix", "app/", []string{"app/a" + action.KVFlagsSuffix}},
+	}
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "kvtree")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		out := filepath.Join(dir, "out")
+		var actions action.Actions
+		for _, k := range tt.keys {
+			actions = append(actions, &action.KVSet{Key: k, KVValue: action.KVValue{Value: "v"}})
+		}
+		err = saveKVTree(out, tt.prefix, actions)
+		if err == nil {
+			t.Errorf("%s: saveKVTree(%q) succeeded, want an error", tt.name, tt.keys)
+		}
+		// Nothing is written when any key is refused.
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("%s: saveKVTree(%q) wrote to %q", tt.name, tt.keys, out)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "etc")); !os.IsNotExist(err) {
+			t.Errorf("%s: saveKVTree(%q) wrote outside of %q", tt.name, tt.keys, out)
+		}
+	}
+}
+
+func TestKVTreeRoundTrip(t *testing.T) {
+	tests := []struct {
+		prefix string
+		keys   map[string]string
+		flags  map[string]uint64
+	}{
+		{"config", map[string]string{"config/db": "postgres", "config/web/port": "80", "config/empty/": ""}, map[string]uint64{"config/db": 7}},
+		{"config/", map[string]string{"config/db": "postgres"}, nil},
+		{"", map[string]string{"a": "1", "b/c": "2"}, nil},
+	}
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "kvtree")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		var exported action.Actions
+		for k, v := range tt.keys {
+			exported = append(exported, &action.KVSet{Key: k, Flags: tt.flags[k], KVValue: action.KVValue{Value: v}})
+		}
+		tree, err := exportKVTree(filepath.Join(dir, "out"), tt.prefix, exported)
+		if err != nil {
+			t.Fatalf("exportKVTree(%q) = %v", tt.prefix, err)
+		}
+		pairs, err := tree.(*action.KVSetTree).Pairs()
+		if err != nil {
+			t.Fatalf("Pairs() = %v", err)
+		}
+		loaded := make(map[string]string)
+		for _, p := range pairs {
+			loaded[p.Key] = string(p.Value)
+			if p.Flags != tt.flags[p.Key] {
+				t.Errorf("prefix %q: key %q has flags %d, want %d", tt.prefix, p.Key, p.Flags, tt.flags[p.Key])
+			}
+		}
+		if len(loaded) != len(tt.keys) {
+			t.Errorf("prefix %q: loaded %q, want %q", tt.prefix, loaded, tt.keys)
+		}
+		for k, v := range tt.keys {
+			if lv, ok := loaded[k]; !ok || lv != v {
+				t.Errorf("prefix %q: key %q loaded as %q (%t), want %q", tt.prefix, k, lv, ok, v)
+			}
+		}
+	}
+}
+
+// catalogServer serves a catalog with two nodes where each endpoint has its
+// own index, as a live cluster does. nodesIndex is called for each read of
+// the node list.
+func catalogServer(nodesIndex func() int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			index int
+			body  string
+		)
+		switch r.URL.Path {
+		case "/v1/catalog/nodes":
+			index = nodesIndex()
+			body = `[{"Node":"n1","Address":"10.0.0.1"},{"Node":"n2","Address":"10.0.0.2"}]`
+		case "/v1/catalog/services":
+			index = 20
+			body = `{"web":[]}`
+		case "/v1/catalog/node/n1":
+			index = 37
+			body = `{"Node":{"Node":"n1","Address":"10.0.0.1"},"Services":{"web":{"ID":"web","Service":"web","Port":80}}}`
+		case "/v1/catalog/node/n2":
+			index = 41
+			body = `{"Node":{"Node":"n2","Address":"10.0.0.2"},"Services":{}}`
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Consul-Index", strconv.Itoa(index))
+		io.WriteString(w, body)
+	}))
+}
+
+func TestExportExternalNode(t *testing.T) {
+	tests := []struct {
+		name       string
+		nodesIndex func() int
+		nodes      int
+		changed    bool
+	}{
+		{"stable with different node indexes", func() int { return 10 }, 2, false},
+		{"changing", func() func() int {
+			i := 10
+			return func() int { i++; return i }
+		}(), 0, true},
+	}
+	for _, tt := range tests {
+		s := catalogServer(tt.nodesIndex)
+		defer s.Close()
+		ctx, err := parseConsulFlag(s.URL, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := exportExternalNode(&ctx, nil, &exportOptions{workers: 2})
+		if _, ok := err.(catalogChangedError); ok != tt.changed {
+			t.Errorf("%s: exportExternalNode() error = %v, want catalog changed %t", tt.name, err, tt.changed)
+			continue
+		}
+		if !tt.changed && err != nil {
+			t.Errorf("%s: exportExternalNode() = %v", tt.name, err)
+		}
+		if len(a) != tt.nodes {
+			t.Errorf("%s: exportExternalNode() = %v, want %d nodes", tt.name, a, tt.nodes)
+		}
+	}
+}
+
+func TestExportConfigEntries(t *testing.T) {
+	unsupported := map[string]string{
+		"ingress-gateway":     "500 invalid config entry kind: ingress-gateway",
+		"terminating-gateway": "404 ",
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind := filepath.Base(r.URL.Path)
+		if r.URL.Query().Get("token") == "denied" {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		if e, ok := unsupported[kind]; ok {
+			code, _ := strconv.Atoi(e[:3])
+			http.Error(w, e[4:], code)
+			return
+		}
+		io.WriteString(w, `[{"Kind": "`+kind+`", "Name": "web"}]`)
+	}))
+	defer s.Close()
+
+	tests := []struct {
+		name    string
+		token   string
+		kinds   []string
+		entries int
+		ok      bool
+	}{
+		{"all skips unsupported kinds", "", nil, len(action.ConfigEntryKinds) - 2, true},
+		{"supported kind", "", []string{"service-defaults"}, 1, true},
+		{"unsupported kind that was asked for", "", []string{"ingress-gateway"}, 0, false},
+		{"other errors", "denied", nil, 0, false},
+	}
+	for _, tt := range tests {
+		ctx, err := parseConsulFlag(s.URL, tt.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := exportConfigEntries(&ctx, nil, tt.kinds, &exportOptions{consistency: "default"})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: exportConfigEntries() error = %v, want ok %t", tt.name, err, tt.ok)
+		}
+		if len(a) != tt.entries {
+			t.Errorf("%s: exported %d entries, want %d", tt.name, len(a), tt.entries)
+		}
+	}
+}
+
+// kvStore is a fake consul KV store.
+type kvStore struct {
+	sync.Mutex
+	kv map[string]string
+}
+
+func (s *kvStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	switch r.Method {
+	case "PUT":
+		b, _ := ioutil.ReadAll(r.Body)
+		s.kv[key] = string(b)
+		io.WriteString(w, "true")
+	case "DELETE":
+		delete(s.kv, key)
+		io.WriteString(w, "true")
+	case "GET":
+		var keys []string
+		for k := range s.kv {
+			if strings.HasPrefix(k, key) {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sort.Strings(keys)
+		if _, ok := r.URL.Query()["keys"]; ok {
+			json.NewEncoder(w).Encode(keys)
+			return
+		}
+		var pairs []*api.KVPair
+		for _, k := range keys {
+			pairs = append(pairs, &api.KVPair{Key: k, Value: []byte(s.kv[k])})
+		}
+		json.NewEncoder(w).Encode(pairs)
+	}
+}
+
+func TestKVDocumentRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		keys map[string]string
+		err  string
+	}{
+		{"flat", map[string]string{"app/a": "1", "app/b": "two"}, ""},
+		{"nested", map[string]string{"app/db/host": "h", "app/db/port": "5432", "app/web/tls/on": "true"}, ""},
+		{"json looking values", map[string]string{"app/n": "8080", "app/j": `{"x": 1}`, "app/e": ""}, ""},
+		{"key is also a prefix", map[string]string{"app/db": "x", "app/db/host": "h"}, "its parent is also a key"},
+		{"key is also a folder", map[string]string{"app/db": "x", "app/db/": ""}, "its parent is also a key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live := &kvStore{kv: map[string]string{"other/x": "y"}}
+			for k, v := range tt.keys {
+				live.kv[k] = v
+			}
+			s := httptest.NewServer(live)
+			defer s.Close()
+			ctx, err := parseConsulFlag(s.URL, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			o := &exportOptions{consistency: "default"}
+			o.kv.prefix = "app/"
+			a, err := exportKVDocument(&ctx, nil, "app", o)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("exportKVDocument() = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			pairs, err := a[0].(*action.KVSetDocument).Pairs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			loaded := make(map[string]string)
+			for _, p := range pairs {
+				loaded[p.Key] = string(p.Value)
+			}
+			if !reflect.DeepEqual(loaded, tt.keys) {
+				t.Errorf("loaded %q, want %q", loaded, tt.keys)
+			}
+		})
+	}
+}
+
+func TestKVDocumentPairs(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		keys map[string]string
+		err  string
+	}{
+		{"leaves", `{"s": "x", "n": 8080, "f": 1.5, "b": true, "z": null, "l": [1, "a"]}`,
+			map[string]string{"app/s": "x", "app/n": "8080", "app/f": "1.5", "app/b": "true", "app/z": "", "app/l": `[1,"a"]`}, ""},
+		{"big number", `{"n": 12345678901234567890}`, map[string]string{"app/n": "12345678901234567890"}, ""},
+		{"nested", `{"a": {"b": {"c": "d"}}}`, map[string]string{"app/a/b/c": "d"}, ""},
+		{"slash in key", `{"a/b": "x"}`, nil, `Invalid document key "a/b"`},
+		{"empty key", `{"a": {"": "x"}}`, nil, `Invalid document key ""`},
+		{"not an object", `["a"]`, nil, "Document must be an object."},
+	}
+	for _, tt := range tests {
+		a := &action.KVSetDocument{Prefix: "app", Document: []byte(tt.doc)}
+		pairs, err := a.Pairs()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: Pairs() = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Pairs() = %v", tt.name, err)
+			continue
+		}
+		keys := make(map[string]string)
+		for _, p := range pairs {
+			keys[p.Key] = string(p.Value)
+		}
+		if !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("%s: Pairs() = %q, want %q", tt.name, keys, tt.keys)
+		}
+	}
+}
+
+func TestKVDocumentPrune(t *testing.T) {
+	live := &kvStore{kv: map[string]string{
+		"app/a":     "old",
+		"app/b/c":   "2",
+		"app/stale": "x",
+		"app/b/old": "x",
+		"apple":     "not under the prefix",
+		"other/x":   "y",
+	}}
+	s := httptest.NewServer(live)
+	defer s.Close()
+	ctx, err := parseConsulFlag(s.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &action.KVSetDocument{Prefix: "app", Document: []byte(`{"a": "1", "b": {"c": "2"}}`), Prune: true}
+	if err := a.Action(&ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"app/a": "1", "app/b/c": "2", "apple": "not under the prefix", "other/x": "y"}
+	if !reflect.DeepEqual(live.kv, want) {
+		t.Errorf("store is %q, want %q", live.kv, want)
+	}
+}
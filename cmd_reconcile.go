@@ -0,0 +1,198 @@
+package main
+
+import (
+	"time"
+
+	api "github.com/armon/consul-api"
+	"github.com/williambailey/consul-register/action"
+)
+
+var cmdReconcile = &Command{
+	Usage: "reconcile [options] file.json...",
+	Short: "Keep the consul server in line with a list of actions.",
+	Long: `
+    Reconcile runs until it is stopped. The actions in the files are
+    compared with the consul server every -interval, and whenever a
+    blocking query reports a change to the KV prefix or catalog that the
+    actions manage. The actions for any items that have drifted are applied
+    again, in file order and after any actions that they depend on, so
+    manual changes are reverted.
+
+    Actions that delete a KV tree can remove keys that later actions set,
+    so each run compares again after applying until there is no drift or
+    -passes is reached.
+    `,
+	Run: runReconcile,
+}
+
+var (
+	flagReconcile struct {
+		server        string
+		token         string
+		interval      time.Duration
+		passes        int
+		metricsAddr   string
+		options       exportOptions
+		retry         retryPolicy
+		actionTimeout time.Duration
+	}
+)
+
+func init() {
+	consulFlag(&cmdReconcile.Flag, &flagReconcile.server, &flagReconcile.token)
+	cmdReconcile.Flag.DurationVar(&flagReconcile.interval, "interval", 30*time.Second, "How often to compare with the consul server.")
+	cmdReconcile.Flag.IntVar(&flagReconcile.passes, "passes", 3, "Maximum number of passes in each run.")
+	metricsFlag(&cmdReconcile.Flag, &flagReconcile.metricsAddr)
+	flagReconcile.options.flag(&cmdReconcile.Flag)
+	retryFlag(&cmdReconcile.Flag, &flagReconcile.retry)
+	timeoutFlag(&cmdReconcile.Flag, nil, &flagReconcile.actionTimeout)
+}
+
+func runReconcile(cmd *Command, args []string) {
+	var (
+		err     error
+		ctx     action.Ctx
+		actions action.Actions
+		r       = &applier{ctx: &ctx}
+	)
+	if len(args) < 1 {
+		cmd.UsageExit(nil)
+	}
+	ctx, err = parseConsulFlag(flagReconcile.server, flagReconcile.token)
+	if err != nil {
+		cmd.UsageExit(err)
+	}
+	err = flagReconcile.options.validate()
+	if err != nil {
+		cmd.UsageExit(err)
+	}
+	r.retry = flagReconcile.retry
+	r.actionTimeout = flagReconcile.actionTimeout
+	r.stop = stopOnSignal()
+	actions, r.options, err = loadJSONActions(args...)
+	if err != nil {
+		cmd.UsageExit(err)
+	}
+	desired := newState()
+	err = desired.apply(actions)
+	if err != nil {
+		cmd.UsageExit(err)
+	}
+
+	trigger := make(chan struct{}, 1)
+	if len(desired.kv) > 0 || len(desired.kvPrefixes) > 0 {
+		prefix := desired.kvPrefix()
+		go watchIndex(trigger, func(q *api.QueryOptions) (*api.QueryMeta, error) {
+			_, meta, err := ctx.API.KV().Keys(prefix, "", q)
+			return meta, err
+		})
+	}
+	if len(desired.nodes) > 0 {
+		go watchIndex(trigger, func(q *api.QueryOptions) (*api.QueryMeta, error) {
+			_, meta, err := ctx.API.Catalog().Nodes(q)
+			return meta, err
+		})
+		go watchIndex(trigger, func(q *api.QueryOptions) (*api.QueryMeta, error) {
+			_, meta, err := ctx.API.Catalog().Services(q)
+			return meta, err
+		})
+	}
+
+	serveMetrics(flagReconcile.metricsAddr)
+	logf("Reconciling %d actions.", len(actions))
+	ticker := time.NewTicker(flagReconcile.interval)
+	for {
+		drift, err := doReconcile(r, actions, flagReconcile.options, flagReconcile.passes)
+		metrics.setDrift(drift)
+		if err != nil {
+			logError(err)
+		} else {
+			metrics.success()
+		}
+		emit(event{Event: "summary", Summary: map[string]int{"drift": len(drift)}})
+		select {
+		case <-ticker.C:
+		case <-trigger:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// doReconcile compares the desired state with the consul server and applies
+// the actions for drifted items again. Actions whose condition does not hold
+// are left out of the desired state. It returns the changes that were found
+// on the first pass.
+func doReconcile(r *applier, actions action.Actions, o exportOptions, passes int) ([]change, error) {
+	var drift []change
+	active, err := activeActions(r.ctx, actions, r.options)
+	if err != nil {
+		return nil, err
+	}
+	desired := newState()
+	err = desired.apply(active)
+	if err != nil {
+		return nil, err
+	}
+	for pass := 0; pass < passes; pass++ {
+		live, err := exportState(r.ctx, desired, o)
+		if err != nil {
+			return drift, err
+		}
+		changes := compare(desired, live)
+		if len(changes) == 0 {
+			return drift, nil
+		}
+		if pass == 0 {
+			drift = changes
+		}
+		redo := make(map[action.Actioner]bool)
+		for _, c := range changes {
+			logf("drift %s", c)
+			emit(changeToEvent(c))
+			redo[c.action] = true
+		}
+		for o, a := range actions {
+			if !redo[a] {
+				continue
+			}
+			if err := r.stopped(); err != nil {
+				return drift, err
+			}
+			d, err := r.run(a)
+			if err == errConditionFalse {
+				logf("%s %s", errConditionFalse, a)
+				continue
+			}
+			if err != nil {
+				return drift, r.options.actionError("apply", o, a, err)
+			}
+			logf("applied %s", a)
+			e := r.event("applied", o, a)
+			e.Duration = d.Seconds()
+			emit(e)
+		}
+	}
+	return drift, nil
+}
+
+// watchIndex runs a blocking query over and over, sending to trigger each
+// time the index changes.
+func watchIndex(trigger chan<- struct{}, query func(q *api.QueryOptions) (*api.QueryMeta, error)) {
+	var index uint64
+	for {
+		meta, err := query(&api.QueryOptions{WaitIndex: index, WaitTime: 5 * time.Minute})
+		if err != nil {
+			logError(err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if index != 0 && meta.LastIndex != index {
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+		}
+		index = meta.LastIndex
+	}
+}
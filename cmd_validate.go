@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+var cmdValidate = &Command{
+	Usage: "validate [options] file.json...",
+	Short: "Check that a list of actions is valid.",
+	Long: `
+    Every action in the files is loaded and validated without contacting
+    the consul server. All of the problems are reported, and the exit code
+    is 1 when there are any. Once every action is valid the IDs named in
+    DependsOn are checked across all of the files, including that they do
+    not form a cycle.
+    `,
+	Run: runValidate,
+}
+
+var (
+	flagValidate struct {
+		junit string
+	}
+)
+
+func init() {
+	junitFlag(&cmdValidate.Flag, &flagValidate.junit)
+}
+
+func runValidate(cmd *Command, args []string) {
+	if len(args) < 1 {
+		cmd.UsageExit(nil)
+	}
+	var items []jsonItem
+	for _, f := range args {
+		l, err := loadJSONItems(f)
+		if err != nil {
+			cmd.UsageExit(err)
+		}
+		items = append(items, l...)
+	}
+	report := &junitSuite{Name: strings.Join(args, " ")}
+	failed := 0
+	for _, i := range items {
+		if i.err != nil {
+			failed++
+			printf("%s\n\n", i.err)
+			emit(errorEvent(i.err))
+			report.fail(i.action, i.name, i.err)
+			continue
+		}
+		e := actionEvent("valid", i.options.index, i.action)
+		e.File = i.options.file
+		emit(e)
+		report.pass(i.action, 0)
+	}
+	if failed == 0 {
+		var (
+			actions action.Actions
+			options = make(actionOptions)
+		)
+		for _, i := range items {
+			actions = append(actions, i.action)
+			options[i.action] = i.options
+		}
+		_, err := orderActions(actions, options)
+		if err != nil {
+			failed++
+			printf("%s\n\n", err)
+			emit(errorEvent(err))
+			report.fail(nil, "DependsOn", err)
+		}
+	}
+	if flagValidate.junit != "" {
+		err := report.write(flagValidate.junit)
+		if err != nil {
+			fatal(err, nil)
+		}
+	}
+	emit(event{Event: "summary", Summary: map[string]int{"actions": len(items), "failed": failed}})
+	if failed > 0 {
+		os.Exit(1)
+	}
+	printf("%d actions are valid.\n", len(items))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+// condition guards an action on the live state of the cluster. Every field
+// that is set must hold for the action to be applied.
+type condition struct {
+	KeyExists         string            `json:",omitempty"`
+	KeyEquals         map[string]string `json:",omitempty"`
+	NodeRegistered    string            `json:",omitempty"`
+	ServiceRegistered string            `json:",omitempty"`
+	Datacenter        string            `json:",omitempty"`
+	Env               map[string]string `json:",omitempty"`
+	Not               *condition        `json:",omitempty"`
+}
+
+// errConditionFalse is returned instead of applying an action whose
+// condition does not hold.
+var errConditionFalse = errors.New("skipped (condition false)")
+
+// Validate the condition.
+func (c *condition) Validate() error {
+	if c.KeyExists == "" && len(c.KeyEquals) == 0 && c.NodeRegistered == "" &&
+		c.ServiceRegistered == "" && c.Datacenter == "" && len(c.Env) == 0 && c.Not == nil {
+		return errors.New("When must not be empty.")
+	}
+	if c.Not != nil {
+		return c.Not.Validate()
+	}
+	return nil
+}
+
+// String representation of the condition.
+func (c *condition) String() string {
+	var s []string
+	if c.KeyExists != "" {
+		s = append(s, fmt.Sprintf("key %q exists", c.KeyExists))
+	}
+	for _, k := range sortedStrings(c.KeyEquals) {
+		s = append(s, fmt.Sprintf("key %q is %q", k, c.KeyEquals[k]))
+	}
+	if c.NodeRegistered != "" {
+		s = append(s, fmt.Sprintf("node %q is registered", c.NodeRegistered))
+	}
+	if c.ServiceRegistered != "" {
+		s = append(s, fmt.Sprintf("service %q is registered", c.ServiceRegistered))
+	}
+	if c.Datacenter != "" {
+		s = append(s, fmt.Sprintf("datacenter is %q", c.Datacenter))
+	}
+	for _, k := range sortedStrings(c.Env) {
+		s = append(s, fmt.Sprintf("$%s is %q", k, c.Env[k]))
+	}
+	if c.Not != nil {
+		s = append(s, fmt.Sprintf("not (%s)", c.Not))
+	}
+	return strings.Join(s, " and ")
+}
+
+// holds reports whether the condition is true for the cluster.
+func (c *condition) holds(ctx *action.Ctx) (bool, error) {
+	for _, k := range sortedStrings(c.Env) {
+		if os.Getenv(k) != c.Env[k] {
+			return false, nil
+		}
+	}
+	if c.KeyExists != "" {
+		p, _, err := ctx.API.KV().Get(c.KeyExists, nil)
+		if err != nil || p == nil {
+			return false, err
+		}
+	}
+	for _, k := range sortedStrings(c.KeyEquals) {
+		p, _, err := ctx.API.KV().Get(k, nil)
+		if err != nil || p == nil || string(p.Value) != c.KeyEquals[k] {
+			return false, err
+		}
+	}
+	if c.NodeRegistered != "" {
+		n, _, err := ctx.API.Catalog().Node(c.NodeRegistered, nil)
+		if err != nil || n == nil || n.Node == nil {
+			return false, err
+		}
+	}
+	if c.ServiceRegistered != "" {
+		s, _, err := ctx.API.Catalog().Service(c.ServiceRegistered, "", nil)
+		if err != nil || len(s) == 0 {
+			return false, err
+		}
+	}
+	if c.Datacenter != "" {
+		self, err := ctx.API.Agent().Self()
+		if err != nil {
+			return false, err
+		}
+		if dc, _ := self["Config"]["Datacenter"].(string); dc != c.Datacenter {
+			return false, nil
+		}
+	}
+	if c.Not != nil {
+		ok, err := c.Not.holds(ctx)
+		return !ok && err == nil, err
+	}
+	return true, nil
+}
+
+// resources returns the resources that the condition reads, so that it is
+// checked after the actions before it that change them.
+func (c *condition) resources() []resource {
+	var res []resource
+	if c.KeyExists != "" {
+		res = append(res, resource{kind: "kv", name: c.KeyExists})
+	}
+	for _, k := range sortedStrings(c.KeyEquals) {
+		res = append(res, resource{kind: "kv", name: k})
+	}
+	if c.NodeRegistered != "" {
+		res = append(res, resource{kind: "node", name: c.NodeRegistered})
+	}
+	if c.ServiceRegistered != "" {
+		// Any node can provide the service.
+		res = append(res, resource{kind: "node", prefix: true})
+	}
+	if c.Not != nil {
+		res = append(res, c.Not.resources()...)
+	}
+	return res
+}
+
+// activeActions returns the actions whose condition holds, or that have no
+// condition.
+func activeActions(ctx *action.Ctx, actions action.Actions, options actionOptions) (action.Actions, error) {
+	var active action.Actions
+	for o, a := range actions {
+		w := options.get(a).When
+		if w == nil {
+			active = append(active, a)
+			continue
+		}
+		ok, err := w.holds(ctx)
+		if err != nil {
+			return nil, options.actionError("evaluate", o, a, err)
+		}
+		if ok {
+			active = append(active, a)
+		}
+	}
+	return active, nil
+}
+
+func sortedStrings(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+// hookOptions are the shell commands that are run before and after the
+// actions are applied.
+type hookOptions struct {
+	pre     string
+	post    string
+	timeout time.Duration
+}
+
+func (h *hookOptions) flag(flag *flag.FlagSet) {
+	flag.StringVar(&h.pre, "pre-apply", "", "Shell command to run before applying, a failure stops the run.")
+	flag.StringVar(&h.post, "post-apply", "", "Shell command to run after applying, even when applying failed.")
+	flag.DurationVar(&h.timeout, "hook-timeout", time.Minute, "Cancel a hook that takes longer than this, 0 for no limit.")
+}
+
+// runPre runs the pre-apply hook, if there is one.
+func (h *hookOptions) runPre(ctx *action.Ctx, filenames []string, actions action.Actions) error {
+	if h.pre == "" {
+		return nil
+	}
+	return h.run(ctx, "pre-apply", h.pre, map[string]string{
+		"CONSUL_REGISTER_FILE":    strings.Join(filenames, " "),
+		"CONSUL_REGISTER_ACTIONS": strconv.Itoa(len(actions)),
+	})
+}
+
+// runPost runs the post-apply hook, if there is one, with the result of
+// applying the actions.
+func (h *hookOptions) runPost(ctx *action.Ctx, filenames []string, actions action.Actions, done []outcome, err error) error {
+	if h.post == "" {
+		return nil
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	return h.run(ctx, "post-apply", h.post, map[string]string{
+		"CONSUL_REGISTER_FILE":    strings.Join(filenames, " "),
+		"CONSUL_REGISTER_ACTIONS": strconv.Itoa(len(actions)),
+		"CONSUL_REGISTER_APPLIED": strconv.Itoa(countOutcome(done, outcomeApplied)),
+		"CONSUL_REGISTER_SKIPPED": strconv.Itoa(countOutcome(done, outcomeSkipped)),
+		"CONSUL_REGISTER_RESULT":  result,
+	})
+}
+
+// run the hook with only -hook-timeout as its deadline. It does not share
+// the deadline of the run, so that the post-apply hook still runs after the
+// run has timed out.
+func (h *hookOptions) run(ctx *action.Ctx, stage, command string, env map[string]string) error {
+	ctx = ctx.WithContext(context.Background())
+	e := &action.Exec{
+		Command: []string{"sh", "-c", command},
+		Env:     env,
+	}
+	if h.timeout > 0 {
+		e.Timeout = h.timeout.String()
+	}
+	printf("!! Running %s hook.\n", stage)
+	start := time.Now()
+	err := e.Action(ctx)
+	if err != nil {
+		return fmt.Errorf("Unable to run the %s hook.\n\n%s", stage, err)
+	}
+	if o := strings.TrimRight(e.Output(), "\n"); o != "" {
+		printf("%s\n", o)
+	}
+	emit(event{Event: "hook", Stage: stage, Message: e.Output(), Duration: time.Since(start).Seconds()})
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+func TestPostHookRunsAfterTimeout(t *testing.T) {
+	c, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-c.Done()
+	h := &hookOptions{post: "exit 0", timeout: time.Minute}
+	err := h.runPost(&action.Ctx{Context: c}, []string{"a.json"}, nil, nil, c.Err())
+	if err != nil {
+		t.Errorf("post-apply hook did not run after the run timed out: %s", err)
+	}
+
+	h = &hookOptions{post: "exec sleep 5", timeout: 50 * time.Millisecond}
+	err = h.runPost(&action.Ctx{Context: context.Background()}, nil, nil, nil, nil)
+	if err == nil {
+		t.Error("post-apply hook was not stopped by -hook-timeout")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"io/ioutil"
+	"time"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+// junitSuite is a JUnit XML test suite where each action is a test case.
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+func junitFlag(flag *flag.FlagSet, filename *string) {
+	flag.StringVar(filename, "junit", "", "Write a JUnit XML report to this file.")
+}
+
+// pass adds a passing test case for the action.
+func (s *junitSuite) pass(a action.Actioner, seconds float64) {
+	s.Tests++
+	s.Cases = append(s.Cases, junitCase{
+		Name:      a.String(),
+		Classname: a.Type(),
+		Time:      seconds,
+	})
+}
+
+// fail adds a failing test case. The action may be nil when it could not
+// be loaded, in which case typ is used to name the test case.
+func (s *junitSuite) fail(a action.Actioner, typ string, err error) {
+	s.Tests++
+	s.Failures++
+	c := junitCase{Name: typ, Classname: typ}
+	if a != nil {
+		c.Name = a.String()
+	}
+	f := &junitFailure{Type: "error", Message: err.Error(), Text: err.Error()}
+	if e, ok := err.(*actionError); ok {
+		f.Type = e.stage
+		f.Message = e.err.Error()
+	}
+	c.Failure = f
+	s.Cases = append(s.Cases, c)
+}
+
+// skip adds a skipped test case for the action.
+func (s *junitSuite) skip(a action.Actioner, msg string) {
+	s.Tests++
+	s.Skipped++
+	s.Cases = append(s.Cases, junitCase{
+		Name:      a.String(),
+		Classname: a.Type(),
+		Skipped:   &junitSkipped{Message: msg},
+	})
+}
+
+// write the report to filename.
+func (s *junitSuite) write(filename string) error {
+	b, err := xml.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append([]byte(xml.Header), b...)
+	return ioutil.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+// junitApply builds the report for a run of applier.apply, where took is how
+// long each action took.
+func junitApply(name string, actions action.Actions, done []outcome, took []time.Duration, dry bool, err error) *junitSuite {
+	s := &junitSuite{Name: name}
+	for o, a := range actions {
+		switch {
+		case done[o] == outcomeSkipped:
+			s.skip(a, "Condition false.")
+		case dry:
+			s.skip(a, "Dry run.")
+		case done[o] == outcomeApplied:
+			s.pass(a, took[o].Seconds())
+		case done[o] == outcomeFailed:
+			s.fail(a, a.Type(), err)
+			s.Cases[len(s.Cases)-1].Time = took[o].Seconds()
+		default:
+			s.skip(a, "Not applied.")
+		}
+	}
+	return s
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+func TestJunitApply(t *testing.T) {
+	actions := action.Actions{kvSet("a", "1"), kvSet("b", "1"), kvSet("c", "1"), kvSet("d", "1")}
+	done := []outcome{outcomeApplied, outcomeSkipped, outcomeFailed, outcomeNotApplied}
+	took := []time.Duration{1500 * time.Millisecond, 0, 250 * time.Millisecond, 0}
+	s := junitApply("a.json", actions, done, took, false, errors.New("boom"))
+
+	tests := []struct {
+		time    float64
+		failed  bool
+		skipped string
+	}{
+		{1.5, false, ""},
+		{0, false, "Condition false."},
+		{0.25, true, ""},
+		{0, false, "Not applied."},
+	}
+	if s.Tests != 4 || s.Failures != 1 || s.Skipped != 2 {
+		t.Errorf("suite has %d tests, %d failures and %d skipped", s.Tests, s.Failures, s.Skipped)
+	}
+	for o, tt := range tests {
+		c := s.Cases[o]
+		if c.Time != tt.time {
+			t.Errorf("case %d has time %g, want %g", o, c.Time, tt.time)
+		}
+		if (c.Failure != nil) != tt.failed {
+			t.Errorf("case %d failure is %v, want failed %t", o, c.Failure, tt.failed)
+		}
+		skipped := ""
+		if c.Skipped != nil {
+			skipped = c.Skipped.Message
+		}
+		if skipped != tt.skipped {
+			t.Errorf("case %d skipped %q, want %q", o, skipped, tt.skipped)
+		}
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"text/template"
 	"unicode"
@@ -69,6 +71,11 @@ func (c *Command) UsageExit(msg interface{}) {
 	fmt.Fprintf(os.Stderr, "Run '%s help %s' for help.\n", Name, c.Name())
 	if msg != nil {
 		fmt.Fprintf(os.Stderr, "\n%s\n\n", msg)
+		if err, ok := msg.(error); ok {
+			emit(errorEvent(err))
+		} else {
+			emit(event{Event: "error", Error: fmt.Sprint(msg)})
+		}
 	}
 	os.Exit(2)
 }
@@ -78,12 +85,32 @@ func (c *Command) UsageExit(msg interface{}) {
 // by 'consul-register help'.
 var commands = []*Command{
 	cmdApply,
+	cmdCopy,
+	cmdDiff,
 	cmdExport,
+	cmdReconcile,
+	cmdValidate,
+}
+
+func init() {
+	// Plugins are only used for types that are not built in.
+	action.DefaultFactories = append(action.DefaultFactories, action.PluginFactory)
 }
 
 func main() {
+	var output string
 	flag.Usage = usageExit
+	flag.StringVar(&output, "output", "text", "Output format, text or json.")
+	flag.StringVar(&action.PluginDir, "plugin-dir", os.Getenv("CONSUL_REGISTER_PLUGIN_DIR"), "Directory to search for plugins before PATH.")
 	flag.Parse()
+	switch output {
+	case "text":
+	case "json":
+		jsonOutput = true
+	default:
+		fmt.Fprintf(os.Stderr, "%s: unknown output %q\n", Name, output)
+		os.Exit(2)
+	}
 	args := flag.Args()
 	if len(args) < 1 {
 		usageExit()
@@ -111,11 +138,17 @@ func main() {
 var usageTemplate = `
 {{appName}} v{{appVersion}} is a tool for managing consul runtime registrations.
 Usage:
-  consul-register command [arguments]
+  consul-register [-output=text|json] [-plugin-dir=dir] command [arguments]
+
+With -output=json every command writes newline delimited JSON events to
+STDOUT, ending with a summary event.
+
+Action types that are not built in are provided by plugin executables named
+consul-register-action-<Type>, found in -plugin-dir or on the PATH.
 
 The commands are:
 {{range .}}
-    {{.Name | printf "%-8s"}} {{.Short}}{{end}}
+    {{.Name | printf "%-9s"}} {{.Short}}{{end}}
 
 Use "consul-register help [command]" for more information about a command.
 `
@@ -174,7 +207,19 @@ func consulFlag(flag *flag.FlagSet, server, token *string) {
 	flag.StringVar(token, "token", "", "Consul token")
 }
 
-func parseConsulFlag(consul, token string) (*api.Client, error) {
+// stringsFlag is a flag that may be given more than once.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+func parseConsulFlag(consul, token string) (action.Ctx, error) {
 	// The api client wants scheme and address separately.
 	var (
 		address string
@@ -183,7 +228,7 @@ func parseConsulFlag(consul, token string) (*api.Client, error) {
 	)
 	u, err := url.Parse(consul)
 	if err != nil {
-		return nil, fmt.Errorf("Invalid consul flag.\n\n%s", err)
+		return action.Ctx{}, fmt.Errorf("Invalid consul flag.\n\n%s", err)
 	}
 	if u.Scheme == "" {
 		scheme = "http"
@@ -192,53 +237,174 @@ func parseConsulFlag(consul, token string) (*api.Client, error) {
 	}
 	u.Scheme = ""
 	address = strings.TrimLeft(u.String(), "/")
-	client, err := api.NewClient(
+	ctx, err := action.NewCtx(
 		&api.Config{
-			Address: address,
-			Scheme:  scheme,
-			Token:   token,
+			Address:    address,
+			Scheme:     scheme,
+			Token:      token,
+			HttpClient: &http.Client{Transport: metricsTransport{http.DefaultTransport}},
 		},
 	)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to create consul api client.\n\n%s", err)
+		return ctx, fmt.Errorf("Unable to create consul api client.\n\n%s", err)
 	}
-	return client, nil
+	return ctx, nil
 }
 
-func loadJSONActions(filename string) (action.Actions, error) {
+// loadJSONActions loads the actions in the files, ordered so that each
+// action comes after the actions that it depends on.
+func loadJSONActions(filenames ...string) (action.Actions, actionOptions, error) {
+	var (
+		actions action.Actions
+		options = make(actionOptions)
+	)
+	for _, filename := range filenames {
+		items, err := loadJSONItems(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, i := range items {
+			if i.err != nil {
+				return nil, nil, i.err
+			}
+			actions = append(actions, i.action)
+			options[i.action] = i.options
+		}
+	}
+	actions, err := orderActions(actions, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return actions, options, nil
+}
+
+// itemOptions are the settings that can be given alongside the config of
+// any action.
+type itemOptions struct {
+	ID        string         `json:",omitempty"`
+	DependsOn []string       `json:",omitempty"`
+	Retry     *retryOverride `json:",omitempty"`
+	When      *condition     `json:",omitempty"`
+
+	// file and index are where the item was loaded from.
+	file  string
+	index int
+}
+
+// actionOptions holds the item options for loaded actions.
+type actionOptions map[action.Actioner]*itemOptions
+
+// get returns the options for the action.
+func (o actionOptions) get(a action.Actioner) *itemOptions {
+	if i, ok := o[a]; ok && i != nil {
+		return i
+	}
+	return &itemOptions{}
+}
+
+// source describes where the action at position i was loaded from, such as
+// `#3 in "a.json"`.
+func (o actionOptions) source(i int, a action.Actioner) string {
+	opt := o.get(a)
+	if opt.file == "" {
+		return fmt.Sprintf("#%d", i+1)
+	}
+	return fmt.Sprintf("#%d in %q", opt.index, opt.file)
+}
+
+// actionError returns the error for the action at position i, giving where
+// the action was loaded from when it is known.
+func (o actionOptions) actionError(stage string, i int, a action.Actioner, err error) *actionError {
+	opt := o.get(a)
+	if opt.file == "" {
+		return &actionError{stage, i + 1, a.Type(), err, ""}
+	}
+	return &actionError{stage, opt.index, a.Type(), err, opt.file}
+}
+
+// inFileOrder reports whether the actions all come from one file in the
+// order that they are in the file, so that positions in the list are
+// positions in the file.
+func (o actionOptions) inFileOrder(actions action.Actions) bool {
+	for i, a := range actions {
+		opt := o.get(a)
+		if opt.file != "" && (opt.index != i+1 || opt.file != o.get(actions[0]).file) {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonItem is an action loaded from JSON, or the error from loading it.
+type jsonItem struct {
+	name    string
+	action  action.Actioner
+	options *itemOptions
+	err     error
+}
+
+// loadJSONItems loads every action in filename, carrying on past actions
+// that can not be loaded so that all of the errors can be reported.
+func loadJSONItems(filename string) ([]jsonItem, error) {
 	type item struct {
 		Action string
 		Config json.RawMessage
+		itemOptions
 	}
 	var (
-		actions action.Actions
-		items   []item
-		err     error
+		loaded []jsonItem
+		items  []item
+		err    error
 	)
 	file, err := os.Open(filename)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to open %q.\n\n%s", file, err)
+		return nil, fmt.Errorf("Unable to open %q.\n\n%s", filename, err)
 	}
+	defer file.Close()
 	err = json.NewDecoder(file).Decode(&items)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to load actions from JSON.\n\n%s", err)
 	}
 	for o, i := range items {
-		a, err := action.DefaultFactories.NewAction(i.Action)
-		if err != nil {
-			return nil, fmt.Errorf("Unable to load action #%d, %s.\n\n%s", o+1, i.Action, err)
+		l := loadJSONItem(filename, o+1, i.Action, i.Config)
+		opts := i.itemOptions
+		opts.file = filename
+		opts.index = o + 1
+		l.options = &opts
+		if l.err == nil && opts.Retry != nil {
+			err = opts.Retry.Validate()
+			if err != nil {
+				l.err = &actionError{"validate", o + 1, i.Action, err, filename}
+			}
 		}
-		err = json.Unmarshal(i.Config, a)
-		if err != nil {
-			return nil, fmt.Errorf("Unable to load action #%d, %s.\n\n%s", o+1, i.Action, err)
+		if l.err == nil && opts.When != nil {
+			err = opts.When.Validate()
+			if err != nil {
+				l.err = &actionError{"validate", o + 1, i.Action, err, filename}
+			}
 		}
-		err = a.Validate()
-		if err != nil {
-			return nil, fmt.Errorf("Unable to load action #%d, %s.\n\n%s", o+1, i.Action, err)
-		}
-		actions = append(actions, a)
+		loaded = append(loaded, l)
+	}
+	return loaded, nil
+}
+
+func loadJSONItem(filename string, index int, name string, config json.RawMessage) jsonItem {
+	a, err := action.DefaultFactories.NewAction(name)
+	if err != nil {
+		return jsonItem{name: name, err: &actionError{"load", index, name, err, filename}}
+	}
+	err = json.Unmarshal(config, a)
+	if err != nil {
+		return jsonItem{name: name, err: &actionError{"load", index, name, err, filename}}
+	}
+	if r, ok := a.(action.DirResolver); ok {
+		r.ResolveDir(filepath.Dir(filename))
+	}
+	err = a.Validate()
+	if err != nil {
+		return jsonItem{name: name, action: a, err: &actionError{"validate", index, name, err, filename}}
 	}
-	return actions, nil
+	return jsonItem{name: name, action: a}
 }
 
 func saveJSONActions(actions action.Actions) (bytes.Buffer, error) {
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+func TestLoadJSONActionsFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "actions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	app := filepath.Join(dir, "app.json")
+	acl := filepath.Join(dir, "acl.json")
+	files := map[string]string{
+		app: `[
+			{"Action": "KVSet", "Config": {"Key": "app/a", "Value": "1"}, "DependsOn": ["acl"]},
+			{"Action": "KVSet", "Config": {"Key": "app/b", "Value": "2"}}
+		]`,
+		acl: `[{"Action": "ACLSet", "Config": {"Name": "app", "Rules": ""}, "ID": "acl"}]`,
+	}
+	for f, s := range files {
+		if err := ioutil.WriteFile(f, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	actions, options, err := loadJSONActions(app, acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`#2 in "` + app + `"`, `#1 in "` + acl + `"`, `#1 in "` + app + `"`}
+	for o, a := range actions {
+		if got := options.source(o, a); got != want[o] {
+			t.Errorf("action %d is from %s, want %s", o, got, want[o])
+		}
+	}
+	if options.inFileOrder(actions) {
+		t.Error("reordered actions from two files are in file order")
+	}
+
+	_, _, err = loadJSONActions(app)
+	e, ok := err.(*actionError)
+	if !ok || e.stage != "order" || e.file != app || e.index != 1 {
+		t.Errorf("got error %#v, want an order error for #1 in %q", err, app)
+	}
+}
+
+func TestLoadKVSetTreePrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "actions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for f, s := range map[string]string{"kv/db": "postgres", "kv/sub/x": "1"} {
+		f = filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(f, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		prefix string
+		keys   []string
+	}{
+		{"config", []string{"config/db", "config/sub/x"}},
+		{"config/", []string{"config/db", "config/sub/x"}},
+		{"", []string{"db", "sub/x"}},
+	}
+	for _, tt := range tests {
+		filename := filepath.Join(dir, "actions.json")
+		s := `[{"Action": "KVSetTree", "Config": {"Prefix": "` + tt.prefix + `", "Dir": "kv"}}]`
+		if err := ioutil.WriteFile(filename, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		actions, _, err := loadJSONActions(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pairs, err := actions[0].(*action.KVSetTree).Pairs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, p := range pairs {
+			keys = append(keys, p.Key)
+		}
+		if !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("prefix %q gives keys %q, want %q", tt.prefix, keys, tt.keys)
+		}
+		res := actionResources(actions[0])
+		if tt.prefix != "" && res[0].name != "config/" {
+			t.Errorf("prefix %q has resource %q, want %q", tt.prefix, res[0].name, "config/")
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metricsBuckets are the upper bounds, in seconds, of the action latency
+// histogram buckets.
+var metricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricsKinds are the resource types that drift is reported for.
+var metricsKinds = []string{"ACL", "ConfigEntry", "KV", "Node", "PreparedQuery", "Service"}
+
+// metrics collects the metrics for the process.
+var metrics = newMetricsRegistry()
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// metricsRegistry holds the metrics and writes them in the Prometheus text
+// format.
+type metricsRegistry struct {
+	sync.Mutex
+	actions     map[[2]string]uint64
+	durations   map[string]*histogram
+	drift       map[string]int
+	lastSuccess time.Time
+	apiErrors   uint64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		actions:   make(map[[2]string]uint64),
+		durations: make(map[string]*histogram),
+		drift:     make(map[string]int),
+	}
+}
+
+// observeAction records the outcome and latency of applying an action.
+func (m *metricsRegistry) observeAction(typ string, d time.Duration, err error) {
+	m.Lock()
+	defer m.Unlock()
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	m.actions[[2]string{typ, outcome}]++
+	h, ok := m.durations[typ]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(metricsBuckets))}
+		m.durations[typ] = h
+	}
+	s := d.Seconds()
+	for i, b := range metricsBuckets {
+		if s <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += s
+}
+
+// setDrift records the number of drifted items per resource type.
+func (m *metricsRegistry) setDrift(changes []change) {
+	m.Lock()
+	defer m.Unlock()
+	for _, k := range metricsKinds {
+		m.drift[k] = 0
+	}
+	for _, c := range changes {
+		m.drift[c.kind]++
+	}
+}
+
+// success records the time of a successful run.
+func (m *metricsRegistry) success() {
+	m.Lock()
+	defer m.Unlock()
+	m.lastSuccess = time.Now()
+}
+
+// apiError records a failed consul API request.
+func (m *metricsRegistry) apiError() {
+	m.Lock()
+	defer m.Unlock()
+	m.apiErrors++
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Lock()
+	defer m.Unlock()
+	m.write(w)
+}
+
+func (m *metricsRegistry) write(w io.Writer) {
+	fmt.Fprintln(w, "# HELP consul_register_actions_total Actions applied by type and outcome.")
+	fmt.Fprintln(w, "# TYPE consul_register_actions_total counter")
+	var keys [][2]string
+	for k := range m.actions {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "consul_register_actions_total{type=%q,outcome=%q} %d\n", k[0], k[1], m.actions[k])
+	}
+
+	fmt.Fprintln(w, "# HELP consul_register_action_duration_seconds Time taken to apply an action.")
+	fmt.Fprintln(w, "# TYPE consul_register_action_duration_seconds histogram")
+	var types []string
+	for t := range m.durations {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		h := m.durations[t]
+		for i, b := range metricsBuckets {
+			fmt.Fprintf(w, "consul_register_action_duration_seconds_bucket{type=%q,le=\"%g\"} %d\n", t, b, h.counts[i])
+		}
+		fmt.Fprintf(w, "consul_register_action_duration_seconds_bucket{type=%q,le=\"+Inf\"} %d\n", t, h.count)
+		fmt.Fprintf(w, "consul_register_action_duration_seconds_sum{type=%q} %g\n", t, h.sum)
+		fmt.Fprintf(w, "consul_register_action_duration_seconds_count{type=%q} %d\n", t, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP consul_register_drift Drifted items found by the last comparison.")
+	fmt.Fprintln(w, "# TYPE consul_register_drift gauge")
+	var kinds []string
+	for k := range m.drift {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	for _, k := range kinds {
+		fmt.Fprintf(w, "consul_register_drift{resource=%q} %d\n", k, m.drift[k])
+	}
+
+	fmt.Fprintln(w, "# HELP consul_register_last_success_timestamp_seconds Time of the last successful run.")
+	fmt.Fprintln(w, "# TYPE consul_register_last_success_timestamp_seconds gauge")
+	var last float64
+	if !m.lastSuccess.IsZero() {
+		last = float64(m.lastSuccess.UnixNano()) / 1e9
+	}
+	fmt.Fprintf(w, "consul_register_last_success_timestamp_seconds %g\n", last)
+
+	fmt.Fprintln(w, "# HELP consul_register_consul_api_errors_total Failed consul API requests.")
+	fmt.Fprintln(w, "# TYPE consul_register_consul_api_errors_total counter")
+	fmt.Fprintf(w, "consul_register_consul_api_errors_total %d\n", m.apiErrors)
+}
+
+// metricsTransport counts consul API requests that fail. A 404 is how
+// consul says that something does not exist, which is a normal answer to a
+// lookup, so it is not counted.
+type metricsTransport struct {
+	http.RoundTripper
+}
+
+func (t metricsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(r)
+	if err != nil || apiFailed(resp.StatusCode) {
+		metrics.apiError()
+	}
+	return resp, err
+}
+
+// apiFailed reports whether a consul API response status is an error.
+func apiFailed(status int) bool {
+	return status >= 500 || (status >= 400 && status != http.StatusNotFound)
+}
+
+func metricsFlag(flag *flag.FlagSet, addr *string) {
+	flag.StringVar(addr, "metrics-addr", "", "Address to serve Prometheus metrics on, for example :9102")
+}
+
+func metricsFileFlag(flag *flag.FlagSet, filename *string) {
+	flag.StringVar(filename, "metrics-file", "", "Write Prometheus metrics to this file when the run ends, for the node exporter textfile collector.")
+}
+
+// writeMetricsFile writes the metrics to filename. The file is written
+// next to filename and renamed into place so that a collector never reads
+// part of it.
+func writeMetricsFile(filename string) error {
+	var b bytes.Buffer
+	metrics.Lock()
+	metrics.write(&b)
+	metrics.Unlock()
+	tmp := filename + ".tmp"
+	err := ioutil.WriteFile(tmp, b.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// serveMetrics serves the metrics on addr in the background.
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		log.Fatalln(http.ListenAndServe(addr, mux))
+	}()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type statusTransport struct {
+	status int
+	err    error
+}
+
+func (t statusTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	return &http.Response{StatusCode: t.status, Body: http.NoBody}, nil
+}
+
+func TestMetricsTransport(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		counts bool
+	}{
+		{"ok", 200, nil, false},
+		{"not found", 404, nil, false},
+		{"forbidden", 403, nil, true},
+		{"conflict", 409, nil, true},
+		{"server error", 500, nil, true},
+		{"unavailable", 503, nil, true},
+		{"transport error", 0, errors.New("connection refused"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := metrics.apiErrors
+			r, _ := http.NewRequest("GET", "http://consul/v1/kv/a", nil)
+			metricsTransport{statusTransport{tt.status, tt.err}}.RoundTrip(r)
+			if got := metrics.apiErrors - before; got != 0 != tt.counts {
+				t.Errorf("counted %d errors, want counted %v", got, tt.counts)
+			}
+		})
+	}
+}
+
+func TestWriteMetricsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "consul_register.prom")
+	if err := writeMetricsFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "consul_register_consul_api_errors_total ") {
+		t.Errorf("metrics file is missing the api errors:\n%s", b)
+	}
+	if _, err := ioutil.ReadFile(filename + ".tmp"); err == nil {
+		t.Error("temporary file was left behind")
+	}
+}
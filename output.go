@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+// jsonOutput is set by the global -output=json flag. Commands then write
+// newline delimited JSON events to STDOUT in place of their usual output.
+var jsonOutput bool
+
+// event is a single line of JSON output.
+type event struct {
+	Event    string          `json:"event"`
+	Time     string          `json:"time"`
+	Index    int             `json:"index,omitempty"`
+	File     string          `json:"file,omitempty"`
+	Type     string          `json:"type,omitempty"`
+	Action   string          `json:"action,omitempty"`
+	Config   action.Actioner `json:"config,omitempty"`
+	Change   *changeEvent    `json:"change,omitempty"`
+	Stage    string          `json:"stage,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Duration float64         `json:"duration,omitempty"`
+	Message  string          `json:"message,omitempty"`
+	Summary  map[string]int  `json:"summary,omitempty"`
+}
+
+// changeEvent describes a change in JSON output.
+type changeEvent struct {
+	Op   string `json:"op"`
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// emit writes the event when the output is JSON.
+func emit(e event) {
+	if !jsonOutput {
+		return
+	}
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	json.NewEncoder(os.Stdout).Encode(e)
+}
+
+// actionEvent returns an event about an action.
+func actionEvent(name string, index int, a action.Actioner) event {
+	return event{
+		Event:  name,
+		Index:  index,
+		Type:   a.Type(),
+		Action: a.String(),
+	}
+}
+
+// errorEvent returns an event for an error, with the stage, index and type of
+// the action when the error is about a single action.
+func errorEvent(err error) event {
+	if e, ok := err.(*actionError); ok {
+		return event{
+			Event: "error",
+			Stage: e.stage,
+			Index: e.index,
+			File:  e.file,
+			Type:  e.action,
+			Error: e.err.Error(),
+		}
+	}
+	return event{Event: "error", Error: err.Error()}
+}
+
+// printf writes to STDOUT when the output is text.
+func printf(format string, args ...interface{}) {
+	if !jsonOutput {
+		fmt.Printf(format, args...)
+	}
+}
+
+// logf writes to the log when the output is text.
+func logf(format string, args ...interface{}) {
+	if !jsonOutput {
+		log.Printf(format, args...)
+	}
+}
+
+// logError logs the error, or emits it as an event when the output is JSON.
+func logError(err error) {
+	if jsonOutput {
+		emit(errorEvent(err))
+		return
+	}
+	log.Println(err)
+}
+
+// fatal reports the error and exits, along with a final summary when the
+// output is JSON.
+func fatal(err error, summary map[string]int) {
+	if jsonOutput {
+		emit(errorEvent(err))
+		emit(event{Event: "summary", Summary: summary})
+		os.Exit(1)
+	}
+	log.Fatalln(err)
+}
+
+// actionError is an error with a single action from a list of actions.
+type actionError struct {
+	stage  string
+	index  int
+	action string
+	err    error
+	file   string
+}
+
+func (e *actionError) Error() string {
+	if e.file != "" {
+		return fmt.Sprintf("Unable to %s action #%d in %q, %s.\n\n%s", e.stage, e.index, e.file, e.action, e.err)
+	}
+	return fmt.Sprintf("Unable to %s action #%d, %s.\n\n%s", e.stage, e.index, e.action, e.err)
+}
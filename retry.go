@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+// retryPolicy controls how an action is retried when it fails with an error
+// that is likely to be transient. It comes from the command line, where
+// Attempts defaults to 1 so that actions are not retried unless asked.
+type retryPolicy struct {
+	Attempts  int
+	BaseDelay jsonDuration
+	MaxDelay  jsonDuration
+	Jitter    float64
+}
+
+func retryFlag(flag *flag.FlagSet, p *retryPolicy) {
+	flag.IntVar(&p.Attempts, "retry-attempts", 1, "Maximum number of attempts for each action, 1 does not retry.")
+	flag.DurationVar((*time.Duration)(&p.BaseDelay), "retry-base-delay", 500*time.Millisecond, "Delay before the first retry, doubled for each retry after.")
+	flag.DurationVar((*time.Duration)(&p.MaxDelay), "retry-max-delay", 10*time.Second, "Maximum delay between retries.")
+	flag.Float64Var(&p.Jitter, "retry-jitter", 0.2, "Fraction of each delay that is randomised.")
+}
+
+// retryOverride is the "Retry" field of an item. Only the fields that are
+// given replace those of the command line policy, so that an explicit zero,
+// such as "Jitter": 0, is kept.
+type retryOverride struct {
+	Attempts  *int          `json:",omitempty"`
+	BaseDelay *jsonDuration `json:",omitempty"`
+	MaxDelay  *jsonDuration `json:",omitempty"`
+	Jitter    *float64      `json:",omitempty"`
+}
+
+// merge returns defaults with the fields that are given in the override.
+func (o *retryOverride) merge(defaults retryPolicy) retryPolicy {
+	m := defaults
+	if o == nil {
+		return m
+	}
+	if o.Attempts != nil {
+		m.Attempts = *o.Attempts
+	}
+	if o.BaseDelay != nil {
+		m.BaseDelay = *o.BaseDelay
+	}
+	if o.MaxDelay != nil {
+		m.MaxDelay = *o.MaxDelay
+	}
+	if o.Jitter != nil {
+		m.Jitter = *o.Jitter
+	}
+	return m
+}
+
+// Validate checks that the given fields are in range.
+func (o *retryOverride) Validate() error {
+	if o.Attempts != nil && *o.Attempts < 1 {
+		return errors.New("Retry Attempts must be at least 1.")
+	}
+	if (o.BaseDelay != nil && *o.BaseDelay < 0) || (o.MaxDelay != nil && *o.MaxDelay < 0) {
+		return errors.New("Retry delays must not be negative.")
+	}
+	if o.Jitter != nil && (*o.Jitter < 0 || *o.Jitter > 1) {
+		return errors.New("Retry Jitter must be between 0 and 1.")
+	}
+	return nil
+}
+
+// delay returns how long to wait before the given retry, starting at 1.
+func (p retryPolicy) delay(retry int) time.Duration {
+	d := time.Duration(p.BaseDelay)
+	for i := 1; i < retry && d < time.Duration(p.MaxDelay); i++ {
+		d *= 2
+	}
+	if d > time.Duration(p.MaxDelay) {
+		d = time.Duration(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 - p.Jitter + 2*p.Jitter*rand.Float64()))
+	}
+	return d
+}
+
+// runAction performs the action, retrying it while it fails with an error
+// that is retryable and attempts remain.
+func runAction(ctx *action.Ctx, a action.Actioner, p retryPolicy) error {
+	for attempt := 1; ; attempt++ {
+		err := a.Action(ctx)
+		if err == nil || attempt >= p.Attempts || !retryable(err) {
+			return err
+		}
+		d := p.delay(attempt)
+		logf("retrying %s in %s, %s", a, d, err)
+		emit(event{Event: "retry", Type: a.Type(), Action: a.String(), Error: err.Error(), Duration: d.Seconds()})
+		if ctx.Context == nil {
+			time.Sleep(d)
+			continue
+		}
+		select {
+		case <-time.After(d):
+		case <-ctx.Context.Done():
+			return err
+		}
+	}
+}
+
+// responseCode matches the error that the consul api gives for a response
+// with an unexpected status code.
+var responseCode = regexp.MustCompile(`Unexpected response code: (\d+)`)
+
+// retryable reports whether the error is likely to be transient, such as
+// a connection failure, a 5xx response or there being no cluster leader.
+// Errors such as 403 permission denied are permanent.
+func retryable(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	s := err.Error()
+	if strings.Contains(s, "No cluster leader") {
+		return true
+	}
+	if m := responseCode.FindStringSubmatch(s); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return code >= 500 || code == 429
+	}
+	return false
+}
+
+// jsonDuration is a time.Duration that is given as a string such as "1s"
+// in JSON.
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(v)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRetryOverrideMerge(t *testing.T) {
+	defaults := retryPolicy{
+		Attempts:  3,
+		BaseDelay: jsonDuration(500 * time.Millisecond),
+		MaxDelay:  jsonDuration(10 * time.Second),
+		Jitter:    0.2,
+	}
+	tests := []struct {
+		name string
+		json string
+		want retryPolicy
+	}{
+		{"none", `null`, defaults},
+		{"empty", `{}`, defaults},
+		{"attempts", `{"Attempts": 5}`, retryPolicy{5, defaults.BaseDelay, defaults.MaxDelay, 0.2}},
+		{"no jitter", `{"Jitter": 0}`, retryPolicy{3, defaults.BaseDelay, defaults.MaxDelay, 0}},
+		{"no delay", `{"BaseDelay": "0s"}`, retryPolicy{3, 0, defaults.MaxDelay, 0.2}},
+		{"all", `{"Attempts": 1, "BaseDelay": "1s", "MaxDelay": "2s", "Jitter": 0.5}`,
+			retryPolicy{1, jsonDuration(time.Second), jsonDuration(2 * time.Second), 0.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var o *retryOverride
+			if err := json.Unmarshal([]byte(tt.json), &o); err != nil {
+				t.Fatal(err)
+			}
+			if got := o.merge(defaults); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryOverrideValidate(t *testing.T) {
+	tests := []struct {
+		json string
+		ok   bool
+	}{
+		{`{}`, true},
+		{`{"Attempts": 1, "Jitter": 0}`, true},
+		{`{"Jitter": 1}`, true},
+		{`{"Attempts": 0}`, false},
+		{`{"Attempts": -1}`, false},
+		{`{"Jitter": -0.1}`, false},
+		{`{"Jitter": 1.5}`, false},
+		{`{"BaseDelay": "-1s"}`, false},
+	}
+	for _, tt := range tests {
+		var o retryOverride
+		if err := json.Unmarshal([]byte(tt.json), &o); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok %v", tt.json, err, tt.ok)
+		}
+	}
+}
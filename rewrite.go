@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+// rewriteRule replaces the from prefix with the to prefix.
+type rewriteRule struct {
+	from string
+	to   string
+}
+
+// rewriteFlag is a list of rewrite rules given as old=new flags.
+type rewriteFlag []rewriteRule
+
+func (f *rewriteFlag) String() string {
+	var s []string
+	for _, r := range *f {
+		s = append(s, r.from+"="+r.to)
+	}
+	return strings.Join(s, ", ")
+}
+
+func (f *rewriteFlag) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 1 {
+		return fmt.Errorf("Invalid rewrite %q, must be old=new.", v)
+	}
+	*f = append(*f, rewriteRule{from: v[:i], to: v[i+1:]})
+	return nil
+}
+
+// apply the first matching rule to s.
+func (f rewriteFlag) apply(s string) string {
+	for _, r := range f {
+		if strings.HasPrefix(s, r.from) {
+			return r.to + s[len(r.from):]
+		}
+	}
+	return s
+}
+
+// rewriteOptions transforms actions before they are applied so that the
+// same action file can be used for different tenants.
+type rewriteOptions struct {
+	kv         rewriteFlag
+	aclName    string
+	nodePrefix string
+}
+
+func (o *rewriteOptions) flag(flag *flag.FlagSet) {
+	flag.Var(&o.kv, "rewrite-kv", "Rewrite a KV prefix, old=new.")
+	flag.StringVar(&o.aclName, "acl-name-template", "", "Template for ACL names, for example \"{{.Name}}-tenant\".")
+	flag.StringVar(&o.nodePrefix, "node-prefix", "", "Prefix added to external node names.")
+}
+
+// String describes the rewrites that are in effect, one per line.
+func (o *rewriteOptions) String() string {
+	var s []string
+	for _, r := range o.kv {
+		s = append(s, fmt.Sprintf("Rewriting KV prefix %q to %q.", r.from, r.to))
+	}
+	if o.aclName != "" {
+		s = append(s, fmt.Sprintf("Rewriting ACL names with %q.", o.aclName))
+	}
+	if o.nodePrefix != "" {
+		s = append(s, fmt.Sprintf("Prefixing node names with %q.", o.nodePrefix))
+	}
+	return strings.Join(s, "\n")
+}
+
+// rewrite the actions, and the When conditions in their options, in place.
+func (o *rewriteOptions) rewrite(actions action.Actions, options actionOptions) error {
+	rewriteKV(actions, o.kv)
+	for _, a := range actions {
+		if w := options.get(a).When; w != nil {
+			o.rewriteCondition(w)
+		}
+	}
+	if o.aclName != "" {
+		t, err := template.New("acl").Parse(o.aclName)
+		if err != nil {
+			return fmt.Errorf("Invalid ACL name template.\n\n%s", err)
+		}
+		name := func(n string) (string, error) {
+			var b bytes.Buffer
+			err := t.Execute(&b, struct{ Name string }{n})
+			return b.String(), err
+		}
+		for _, a := range actions {
+			switch a := a.(type) {
+			case *action.ACLSet:
+				a.Name, err = name(a.Name)
+			case *action.ACLDelete:
+				a.Name, err = name(a.Name)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if o.nodePrefix != "" {
+		for _, a := range actions {
+			switch a := a.(type) {
+			case *action.ExternalNodeRegister:
+				a.Node = o.nodePrefix + a.Node
+			case *action.ExternalNodeDeregister:
+				a.Node = o.nodePrefix + a.Node
+			}
+		}
+	}
+	return nil
+}
+
+// rewriteCondition rewrites the keys and node names that the condition
+// checks in the same way as those of the actions, so that it still checks
+// what the rewritten actions change.
+func (o *rewriteOptions) rewriteCondition(c *condition) {
+	if c.KeyExists != "" {
+		c.KeyExists = o.kv.apply(c.KeyExists)
+	}
+	if len(c.KeyEquals) > 0 {
+		m := make(map[string]string, len(c.KeyEquals))
+		for k, v := range c.KeyEquals {
+			m[o.kv.apply(k)] = v
+		}
+		c.KeyEquals = m
+	}
+	if c.NodeRegistered != "" {
+		c.NodeRegistered = o.nodePrefix + c.NodeRegistered
+	}
+	if c.Not != nil {
+		o.rewriteCondition(c.Not)
+	}
+}
+
+// rewriteKV rewrites the keys and prefixes of KV actions in place.
+func rewriteKV(actions action.Actions, rules rewriteFlag) {
+	if len(rules) == 0 {
+		return
+	}
+	for _, a := range actions {
+		switch a := a.(type) {
+		case *action.KVDelete:
+			a.Key = rules.apply(a.Key)
+		case *action.KVDeleteTree:
+			a.Prefix = rules.apply(a.Prefix)
+		case *action.KVSet:
+			a.Key = rules.apply(a.Key)
+		case *action.KVSetIfNotExist:
+			a.Key = rules.apply(a.Key)
+		case *action.KVSetTree:
+			a.Prefix = rules.apply(a.KeyPrefix())
+		case *action.KVSetDocument:
+			a.Prefix = rules.apply(a.KeyPrefix())
+		}
+	}
+}
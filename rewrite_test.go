@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+func TestRewriteCondition(t *testing.T) {
+	set := kvSet("app/enabled", "true")
+	node := &action.ExternalNodeRegister{Node: "web1", Address: "10.0.0.1"}
+	guarded := &action.ACLSet{Name: "app"}
+	actions := action.Actions{set, node, guarded}
+	options := actionOptions{guarded: {When: &condition{
+		KeyExists: "app/enabled",
+		KeyEquals: map[string]string{"app/mode": "on", "other": "x"},
+		Not:       &condition{NodeRegistered: "web1", ServiceRegistered: "web"},
+	}}}
+	o := &rewriteOptions{kv: rewriteFlag{{"app/", "t1/app/"}}, nodePrefix: "t1-"}
+	if err := o.rewrite(actions, options); err != nil {
+		t.Fatal(err)
+	}
+	want := &condition{
+		KeyExists: "t1/app/enabled",
+		KeyEquals: map[string]string{"t1/app/mode": "on", "other": "x"},
+		Not:       &condition{NodeRegistered: "t1-web1", ServiceRegistered: "web"},
+	}
+	if got := options[guarded].When; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if deps := actionDeps(actions, options)[2]; !reflect.DeepEqual(deps, []int{0, 1}) {
+		t.Errorf("the guarded action depends on %v, want [0 1]", deps)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	tenant := &rewriteOptions{
+		kv:         rewriteFlag{{"app/sub/", "t1/special/"}, {"app/", "t1/app/"}},
+		aclName:    "{{.Name}}-t1",
+		nodePrefix: "t1-",
+	}
+	tests := []struct {
+		name string
+		o    *rewriteOptions
+		a    action.Actioner
+		want action.Actioner
+		err  string
+	}{
+		{"first rule", tenant, kvSet("app/sub/x", "1"), kvSet("t1/special/x", "1"), ""},
+		{"second rule", tenant, kvSet("app/x", "1"), kvSet("t1/app/x", "1"), ""},
+		{"first match wins", &rewriteOptions{kv: rewriteFlag{{"app/", "a/"}, {"app/sub/", "b/"}}},
+			kvSet("app/sub/x", "1"), kvSet("a/sub/x", "1"), ""},
+		{"no match", tenant, kvSet("other/x", "1"), kvSet("other/x", "1"), ""},
+		{"whole prefix only", tenant, kvSet("apple", "1"), kvSet("apple", "1"), ""},
+		{"KVDelete", tenant, &action.KVDelete{Key: "app/x"}, &action.KVDelete{Key: "t1/app/x"}, ""},
+		{"KVDeleteTree", tenant, &action.KVDeleteTree{Prefix: "app/x/"}, &action.KVDeleteTree{Prefix: "t1/app/x/"}, ""},
+		{"KVSetIfNotExist", tenant, &action.KVSetIfNotExist{Key: "app/x"}, &action.KVSetIfNotExist{Key: "t1/app/x"}, ""},
+		{"KVSetTree", tenant, &action.KVSetTree{Prefix: "app", Dir: "d"}, &action.KVSetTree{Prefix: "t1/app/", Dir: "d"}, ""},
+		{"KVSetDocument", tenant, &action.KVSetDocument{Prefix: "app/sub"}, &action.KVSetDocument{Prefix: "t1/special/"}, ""},
+		{"ACLSet", tenant, &action.ACLSet{Name: "web", Rules: "r"}, &action.ACLSet{Name: "web-t1", Rules: "r"}, ""},
+		{"ACLDelete", tenant, &action.ACLDelete{Name: "web"}, &action.ACLDelete{Name: "web-t1"}, ""},
+		{"ExternalNodeRegister", tenant, &action.ExternalNodeRegister{Node: "n1"}, &action.ExternalNodeRegister{Node: "t1-n1"}, ""},
+		{"ExternalNodeDeregister", tenant, &action.ExternalNodeDeregister{Node: "n1"}, &action.ExternalNodeDeregister{Node: "t1-n1"}, ""},
+		{"Exec is not rewritten", tenant, &action.Exec{Command: []string{"app/x"}}, &action.Exec{Command: []string{"app/x"}}, ""},
+		{"PreparedQuerySet is not rewritten", tenant, &action.PreparedQuerySet{Name: "app/x", Service: "web"},
+			&action.PreparedQuerySet{Name: "app/x", Service: "web"}, ""},
+		{"invalid ACL template", &rewriteOptions{aclName: "{{.Name"}, &action.ACLSet{Name: "web"}, nil, "Invalid ACL name template."},
+		{"ACL template error", &rewriteOptions{aclName: "{{.Missing}}"}, &action.ACLSet{Name: "web"}, nil, "Missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.o.rewrite(action.Actions{tt.a}, nil)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("rewrite() = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.a, tt.want) {
+				t.Errorf("got %s, want %s", tt.a, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+// resource is something in consul that an action touches. When prefix is
+// set the resource is every key under name.
+type resource struct {
+	kind   string
+	name   string
+	prefix bool
+}
+
+// overlaps reports whether the two resources could be the same thing.
+func (r resource) overlaps(o resource) bool {
+	if r.kind != o.kind {
+		return false
+	}
+	switch {
+	case r.prefix && o.prefix:
+		return strings.HasPrefix(r.name, o.name) || strings.HasPrefix(o.name, r.name)
+	case r.prefix:
+		return strings.HasPrefix(o.name, r.name)
+	case o.prefix:
+		return strings.HasPrefix(r.name, o.name)
+	}
+	return r.name == o.name
+}
+
+// actionResources returns the resources that the action touches. A nil
+// result means that the action could touch anything.
+func actionResources(a action.Actioner) []resource {
+	switch a := a.(type) {
+	case *action.ACLDelete:
+		return []resource{{kind: "acl", name: a.Name}}
+	case *action.ACLSet:
+		return []resource{{kind: "acl", name: a.Name}}
+	case *action.ExternalNodeRegister:
+		return []resource{{kind: "node", name: a.Node}}
+	case *action.ExternalNodeDeregister:
+		return []resource{{kind: "node", name: a.Node}}
+	case *action.KVDelete:
+		return []resource{{kind: "kv", name: a.Key}}
+	case *action.KVDeleteTree:
+		return []resource{{kind: "kv", name: a.Prefix, prefix: true}}
+	case *action.KVSet:
+		return []resource{{kind: "kv", name: a.Key}}
+	case *action.KVSetIfNotExist:
+		return []resource{{kind: "kv", name: a.Key}}
+	case *action.KVSetTree:
+		return []resource{{kind: "kv", name: a.KeyPrefix(), prefix: true}}
+	case *action.KVSetDocument:
+		return []resource{{kind: "kv", name: a.KeyPrefix(), prefix: true}}
+	case *action.ConfigEntryDelete:
+		return []resource{{kind: "config", name: a.Kind + "/" + a.Name}}
+	case *action.ConfigEntrySet:
+		return []resource{{kind: "config", name: a.Kind + "/" + a.Name}}
+	case *action.PreparedQueryDelete:
+		return []resource{{kind: "query", name: a.Name}}
+	case *action.PreparedQuerySet:
+		return []resource{{kind: "query", name: a.Name}}
+	}
+	return nil
+}
+
+// conflicts reports whether the two actions touch the same resource, and so
+// must be applied in the order that they are given.
+func conflicts(a, b []resource) bool {
+	if a == nil || b == nil {
+		return true
+	}
+	for _, i := range a {
+		for _, j := range b {
+			if i.overlaps(j) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// actionDeps returns, for each action, the earlier actions that must be
+// applied before it. These are the actions that it names in DependsOn and
+// the actions that touch the same resource, including the resources that
+// its When condition reads. The actions must already be in
+// the order given by orderActions.
+func actionDeps(actions action.Actions, options actionOptions) [][]int {
+	explicit, _ := explicitDeps(actions, options)
+	res := make([][]resource, len(actions))
+	for o, a := range actions {
+		res[o] = actionResources(a)
+		if w := options.get(a).When; w != nil && res[o] != nil {
+			res[o] = append(res[o], w.resources()...)
+		}
+	}
+	deps := make([][]int, len(actions))
+	for i := range actions {
+		named := make(map[int]bool)
+		for _, j := range explicit[i] {
+			named[j] = true
+		}
+		for j := 0; j < i; j++ {
+			if named[j] || conflicts(res[i], res[j]) {
+				deps[i] = append(deps[i], j)
+			}
+		}
+	}
+	return deps
+}
+
+// explicitDeps returns, for each action, the actions that it names in
+// DependsOn.
+func explicitDeps(actions action.Actions, options actionOptions) ([][]int, error) {
+	ids := make(map[string]int)
+	for o, a := range actions {
+		id := options.get(a).ID
+		if id == "" {
+			continue
+		}
+		if p, ok := ids[id]; ok {
+			return nil, options.actionError("order", o, a, fmt.Errorf("The ID %q is already used by action %s.", id, options.source(p, actions[p])))
+		}
+		ids[id] = o
+	}
+	deps := make([][]int, len(actions))
+	for o, a := range actions {
+		for _, id := range options.get(a).DependsOn {
+			p, ok := ids[id]
+			if !ok {
+				return nil, options.actionError("order", o, a, fmt.Errorf("DependsOn %q is not the ID of any action.", id))
+			}
+			if p == o {
+				return nil, options.actionError("order", o, a, errors.New("An action can not depend on itself."))
+			}
+			deps[o] = append(deps[o], p)
+		}
+	}
+	return deps, nil
+}
+
+// orderActions returns the actions in an order where every action comes
+// after the actions that it names in DependsOn. Otherwise the actions keep
+// the order that they are given in.
+func orderActions(actions action.Actions, options actionOptions) (action.Actions, error) {
+	deps, err := explicitDeps(actions, options)
+	if err != nil {
+		return nil, err
+	}
+	waiting := make([]int, len(actions))
+	dependents := make([][]int, len(actions))
+	for o, d := range deps {
+		waiting[o] = len(d)
+		for _, p := range d {
+			dependents[p] = append(dependents[p], o)
+		}
+	}
+	var (
+		ordered = make(action.Actions, 0, len(actions))
+		placed  = make([]bool, len(actions))
+	)
+	for len(ordered) < len(actions) {
+		// Place the first action that is not waiting on any other.
+		next := -1
+		for o := range actions {
+			if !placed[o] && waiting[o] == 0 {
+				next = o
+				break
+			}
+		}
+		if next < 0 {
+			return nil, cycleError(actions, options, deps, placed)
+		}
+		placed[next] = true
+		ordered = append(ordered, actions[next])
+		for _, o := range dependents[next] {
+			waiting[o]--
+		}
+	}
+	return ordered, nil
+}
+
+// cycleError describes a dependency cycle among the actions that could not
+// be placed.
+func cycleError(actions action.Actions, options actionOptions, deps [][]int, placed []bool) error {
+	start := 0
+	for placed[start] {
+		start++
+	}
+	// Every unplaced action depends on another unplaced action, so following
+	// those dependencies must come back round to an action already seen.
+	seen := make(map[int]int)
+	var path []int
+	o := start
+	for {
+		if p, ok := seen[o]; ok {
+			path = append(path[p:], o)
+			break
+		}
+		seen[o] = len(path)
+		path = append(path, o)
+		for _, d := range deps[o] {
+			if !placed[d] {
+				o = d
+				break
+			}
+		}
+	}
+	ids := make([]string, len(path))
+	for i, o := range path {
+		ids[i] = fmt.Sprintf("%q", options.get(actions[o]).ID)
+	}
+	return options.actionError("order", path[0], actions[path[0]], fmt.Errorf("DependsOn forms a cycle, %s.", strings.Join(ids, " depends on ")))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+func TestActionDepsWhen(t *testing.T) {
+	set := &action.KVSet{Key: "app/enabled", KVValue: action.KVValue{Value: "true"}}
+	node := &action.ExternalNodeRegister{Node: "web1", Address: "10.0.0.1"}
+	acl := &action.ACLSet{Name: "app"}
+	actions := action.Actions{set, node, acl}
+	tests := []struct {
+		name string
+		when *condition
+		deps []int
+	}{
+		{"none", nil, nil},
+		{"key exists", &condition{KeyExists: "app/enabled"}, []int{0}},
+		{"key equals", &condition{KeyEquals: map[string]string{"app/enabled": "true"}}, []int{0}},
+		{"node", &condition{NodeRegistered: "web1"}, []int{1}},
+		{"service", &condition{ServiceRegistered: "web"}, []int{1}},
+		{"not", &condition{Not: &condition{KeyExists: "app/enabled"}}, []int{0}},
+		{"env", &condition{Env: map[string]string{"X": "1"}}, nil},
+		{"other key", &condition{KeyExists: "app/other"}, nil},
+	}
+	for _, tt := range tests {
+		a := &action.ACLSet{Name: "other"}
+		options := actionOptions{a: &itemOptions{When: tt.when}}
+		deps := actionDeps(append(actions, a), options)
+		if got := deps[len(actions)]; !reflect.DeepEqual(got, tt.deps) {
+			t.Errorf("%s: actionDeps() = %v, want %v", tt.name, got, tt.deps)
+		}
+	}
+}
+
+func TestActionDepsConflicts(t *testing.T) {
+	tests := []struct {
+		name    string
+		first   action.Actioner
+		second  action.Actioner
+		depends bool
+	}{
+		{"same key", kvSet("a", "1"), kvSet("a", "2"), true},
+		{"different keys", kvSet("a", "1"), kvSet("b", "1"), false},
+		{"key under tree", &action.KVDeleteTree{Prefix: "app/"}, kvSet("app/x", "1"), true},
+		{"tree over key", kvSet("app/x", "1"), &action.KVSetDocument{Prefix: "app/"}, true},
+		{"overlapping trees", &action.KVDeleteTree{Prefix: "app/"}, &action.KVDeleteTree{Prefix: "app/sub/"}, true},
+		{"separate trees", &action.KVDeleteTree{Prefix: "app/"}, &action.KVDeleteTree{Prefix: "web/"}, false},
+		{"same acl", &action.ACLSet{Name: "app"}, &action.ACLDelete{Name: "app"}, true},
+		{"different acls", &action.ACLSet{Name: "app"}, &action.ACLSet{Name: "web"}, false},
+		{"same node", &action.ExternalNodeRegister{Node: "n1"}, &action.ExternalNodeDeregister{Node: "n1"}, true},
+		{"different kinds", &action.ACLSet{Name: "app"}, kvSet("app", "1"), false},
+		{"unknown resources before", &action.Exec{Command: []string{"true"}}, kvSet("a", "1"), true},
+		{"unknown resources after", kvSet("a", "1"), &action.Exec{Command: []string{"true"}}, true},
+	}
+	for _, tt := range tests {
+		deps := actionDeps(action.Actions{tt.first, tt.second}, nil)
+		if got := len(deps[1]) == 1; got != tt.depends {
+			t.Errorf("%s: depends = %v, want %v", tt.name, got, tt.depends)
+		}
+		if len(deps[0]) != 0 {
+			t.Errorf("%s: the first action has deps %v", tt.name, deps[0])
+		}
+	}
+}
+
+func TestOrderActions(t *testing.T) {
+	type item struct {
+		id        string
+		dependsOn []string
+	}
+	tests := []struct {
+		name  string
+		items []item
+		order []int
+		err   string
+	}{
+		{"no ids", []item{{}, {}, {}}, []int{0, 1, 2}, ""},
+		{"in order", []item{{id: "a"}, {dependsOn: []string{"a"}}}, []int{0, 1}, ""},
+		{"moved after", []item{{id: "b", dependsOn: []string{"a"}}, {}, {id: "a"}}, []int{1, 2, 0}, ""},
+		{"chain", []item{{id: "c", dependsOn: []string{"b"}}, {id: "b", dependsOn: []string{"a"}}, {id: "a"}}, []int{2, 1, 0}, ""},
+		{"several", []item{{dependsOn: []string{"a", "b"}}, {id: "b"}, {id: "a"}}, []int{1, 2, 0}, ""},
+		{"missing", []item{{id: "a"}, {dependsOn: []string{"x"}}}, nil, `DependsOn "x" is not the ID of any action.`},
+		{"duplicate", []item{{id: "a"}, {id: "a"}}, nil, `The ID "a" is already used by action #1.`},
+		{"itself", []item{{id: "a", dependsOn: []string{"a"}}}, nil, "An action can not depend on itself."},
+		{"cycle", []item{{id: "a", dependsOn: []string{"b"}}, {id: "b", dependsOn: []string{"a"}}}, nil, `DependsOn forms a cycle, "a" depends on "b" depends on "a".`},
+		{"cycle after others", []item{{id: "x"}, {id: "a", dependsOn: []string{"c"}}, {id: "b", dependsOn: []string{"a"}}, {id: "c", dependsOn: []string{"b", "x"}}},
+			nil, `DependsOn forms a cycle, "a" depends on "c" depends on "b" depends on "a".`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actions := make(action.Actions, len(tt.items))
+			options := make(actionOptions)
+			for o, i := range tt.items {
+				actions[o] = &action.ACLSet{Name: string('a' + rune(o))}
+				options[actions[o]] = &itemOptions{ID: i.id, DependsOn: i.dependsOn}
+			}
+			ordered, err := orderActions(actions, options)
+			if tt.err != "" {
+				e, ok := err.(*actionError)
+				if !ok || e.stage != "order" || e.err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var order []int
+			for _, a := range ordered {
+				for o := range actions {
+					if actions[o] == a {
+						order = append(order, o)
+					}
+				}
+			}
+			if !reflect.DeepEqual(order, tt.order) {
+				t.Errorf("order %v, want %v", order, tt.order)
+			}
+		})
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+// state is a model of the consul configuration that actions manage. Applying
+// a list of actions to an empty state gives the state that the actions
+// describe, and applying exported actions gives the live state.
+type state struct {
+	kv            map[string]*kvItem
+	kvPrefixes    map[string]action.Actioner
+	acl           map[string]*aclItem
+	nodes         map[string]*nodeItem
+	queries       map[string]*queryItem
+	configEntries map[string]*configItem
+}
+
+// kvItem is the state of a single key.
+type kvItem struct {
+	present  bool
+	anyValue bool
+	flags    uint64
+	value    []byte
+	action   action.Actioner
+}
+
+// aclItem is the state of a single ACL.
+type aclItem struct {
+	present bool
+	rules   string
+	action  action.Actioner
+}
+
+// nodeItem is the state of an external node. A node is only managed when it
+// has been registered or deregistered as a whole, otherwise only the state
+// of its services is known.
+type nodeItem struct {
+	managed  bool
+	present  bool
+	address  string
+	services map[string]*serviceItem
+	action   action.Actioner
+}
+
+// serviceItem is the state of a service provided by an external node.
+type serviceItem struct {
+	present bool
+	service string
+	tags    []string
+	port    int
+	action  action.Actioner
+}
+
+// queryItem is the state of a prepared query. value describes the fields
+// that a PreparedQuerySet manages.
+type queryItem struct {
+	present bool
+	value   string
+	action  action.Actioner
+}
+
+// configItem is the state of a config entry. entry holds its fields other
+// than Kind and Name.
+type configItem struct {
+	present bool
+	entry   map[string]interface{}
+	action  action.Actioner
+}
+
+func newState() *state {
+	return &state{
+		kv:            make(map[string]*kvItem),
+		kvPrefixes:    make(map[string]action.Actioner),
+		acl:           make(map[string]*aclItem),
+		nodes:         make(map[string]*nodeItem),
+		queries:       make(map[string]*queryItem),
+		configEntries: make(map[string]*configItem),
+	}
+}
+
+// apply the actions to the state in order.
+func (s *state) apply(actions action.Actions) error {
+	for o, a := range actions {
+		err := s.applyAction(a)
+		if err != nil {
+			return &actionError{"model", o + 1, a.Type(), err, ""}
+		}
+	}
+	return nil
+}
+
+// applyAction applies a single action to the state. Actions that the state
+// does not model, such as Exec, EventFire and plugins, leave it as it is.
+func (s *state) applyAction(a action.Actioner) error {
+	switch a := a.(type) {
+	case *action.KVSet:
+		v, err := a.Bytes()
+		if err != nil {
+			return err
+		}
+		s.kv[a.Key] = &kvItem{present: true, flags: a.Flags, value: v, action: a}
+	case *action.KVSetIfNotExist:
+		if i, ok := s.kv[a.Key]; ok && i.present {
+			return nil
+		}
+		v, err := a.Bytes()
+		if err != nil {
+			return err
+		}
+		s.kv[a.Key] = &kvItem{present: true, anyValue: true, flags: a.Flags, value: v, action: a}
+	case *action.KVDelete:
+		s.kv[a.Key] = &kvItem{action: a}
+	case *action.KVDeleteTree:
+		s.deleteKVTree(a.Prefix, a)
+	case *action.KVSetTree:
+		pairs, err := a.Pairs()
+		if err != nil {
+			return err
+		}
+		for _, p := range pairs {
+			s.kv[p.Key] = &kvItem{present: true, flags: p.Flags, value: p.Value, action: a}
+		}
+	case *action.KVSetDocument:
+		pairs, err := a.Pairs()
+		if err != nil {
+			return err
+		}
+		if a.Prune {
+			s.deleteKVTree(a.KeyPrefix(), a)
+		}
+		for _, p := range pairs {
+			s.kv[p.Key] = &kvItem{present: true, flags: p.Flags, value: p.Value, action: a}
+		}
+	case *action.ACLSet:
+		s.acl[a.Name] = &aclItem{present: true, rules: a.Rules, action: a}
+	case *action.ACLDelete:
+		s.acl[a.Name] = &aclItem{action: a}
+	case *action.ExternalNodeRegister:
+		n := s.node(a.Node)
+		if n.managed && !n.present {
+			n.services = make(map[string]*serviceItem)
+		}
+		n.managed = true
+		n.present = true
+		n.address = a.Address
+		n.action = a
+		for _, sv := range a.Services {
+			id := sv.ID
+			if id == "" {
+				id = sv.Service
+			}
+			n.services[id] = &serviceItem{
+				present: true,
+				service: sv.Service,
+				tags:    sv.Tags,
+				port:    sv.Port,
+				action:  a,
+			}
+		}
+	case *action.ExternalNodeDeregister:
+		n := s.node(a.Node)
+		if len(a.Services) < 1 {
+			n.managed = true
+			n.present = false
+			n.address = ""
+			n.services = make(map[string]*serviceItem)
+			n.action = a
+			return nil
+		}
+		for _, id := range a.Services {
+			n.services[id] = &serviceItem{action: a}
+		}
+	case *action.PreparedQuerySet:
+		v, err := queryString(a)
+		if err != nil {
+			return err
+		}
+		s.queries[queryKey(a.Name, a.TemplateType != "")] = &queryItem{present: true, value: v, action: a}
+	case *action.PreparedQueryDelete:
+		// The delete removes every query with the name, template or not.
+		s.queries[queryKey(a.Name, false)] = &queryItem{action: a}
+		s.queries[queryKey(a.Name, true)] = &queryItem{action: a}
+	case *action.ConfigEntrySet:
+		entry, err := decodeEntry(a.Entry)
+		if err != nil {
+			return err
+		}
+		s.configEntries[a.Kind+"/"+a.Name] = &configItem{present: true, entry: entry, action: a}
+	case *action.ConfigEntryDelete:
+		s.configEntries[a.Kind+"/"+a.Name] = &configItem{action: a}
+	}
+	return nil
+}
+
+// queryKey is the key of a prepared query in the state. Templates are kept
+// apart from queries because a PreparedQuerySet only matches its own sort.
+func queryKey(name string, template bool) string {
+	if template {
+		return name + " (template)"
+	}
+	return name
+}
+
+// queryString describes the fields of a prepared query that are managed.
+func queryString(a *action.PreparedQuerySet) (string, error) {
+	q := *a
+	q.Tags = append([]string(nil), a.Tags...)
+	sort.Strings(q.Tags)
+	b, err := json.Marshal(&q)
+	return string(b), err
+}
+
+// decodeEntry decodes the fields of a config entry.
+func decodeEntry(raw json.RawMessage) (map[string]interface{}, error) {
+	entry := make(map[string]interface{})
+	if len(raw) == 0 {
+		return entry, nil
+	}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	err := d.Decode(&entry)
+	return entry, err
+}
+
+// configKinds returns the kinds of config entry in the state.
+func (s *state) configKinds() []string {
+	seen := make(map[string]bool)
+	var kinds []string
+	for key := range s.configEntries {
+		kind := key[:strings.Index(key, "/")]
+		if !seen[kind] {
+			seen[kind] = true
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// deleteKVTree marks every key under the prefix as absent.
+func (s *state) deleteKVTree(prefix string, a action.Actioner) {
+	for k := range s.kv {
+		if strings.HasPrefix(k, prefix) {
+			delete(s.kv, k)
+		}
+	}
+	s.kvPrefixes[prefix] = a
+}
+
+func (s *state) node(name string) *nodeItem {
+	n, ok := s.nodes[name]
+	if !ok {
+		n = &nodeItem{services: make(map[string]*serviceItem)}
+		s.nodes[name] = n
+	}
+	return n
+}
+
+// kvPrefix returns the longest prefix shared by all keys and prefixes in the
+// state so that only the part of the KV store that matters has to be read.
+func (s *state) kvPrefix() string {
+	var keys []string
+	for k := range s.kv {
+		keys = append(keys, k)
+	}
+	for p := range s.kvPrefixes {
+		keys = append(keys, p)
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	prefix := keys[0]
+	for _, k := range keys[1:] {
+		for !strings.HasPrefix(k, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// ownsKV reports whether the key is under a prefix that the state manages.
+func (s *state) ownsKV(key string) (action.Actioner, bool) {
+	for p, a := range s.kvPrefixes {
+		if strings.HasPrefix(key, p) {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+// change is a single difference between a desired and a live state.
+type change struct {
+	op     string
+	kind   string
+	name   string
+	from   string
+	to     string
+	action action.Actioner
+}
+
+// String representation of the change.
+func (c change) String() string {
+	switch c.op {
+	case "+":
+		return fmt.Sprintf("+ %s %q %s", c.kind, c.name, c.to)
+	case "-":
+		return fmt.Sprintf("- %s %q %s", c.kind, c.name, c.from)
+	}
+	return fmt.Sprintf("~ %s %q %s => %s", c.kind, c.name, c.from, c.to)
+}
+
+// compare the desired state with the live state. The changes are what
+// applying the desired state would do to the live state, in a stable order.
+func compare(desired, live *state) []change {
+	var changes []change
+	add := func(c change) {
+		changes = append(changes, c)
+	}
+
+	for _, k := range sortedKeys(desired.kv) {
+		d := desired.kv[k]
+		l, ok := live.kv[k]
+		switch {
+		case d.present && (!ok || !l.present):
+			add(change{op: "+", kind: "KV", name: k, to: kvString(d), action: d.action})
+		case !d.present && ok && l.present:
+			add(change{op: "-", kind: "KV", name: k, from: kvString(l), action: d.action})
+		case d.present && !d.anyValue && (d.flags != l.flags || !bytes.Equal(d.value, l.value)):
+			add(change{op: "~", kind: "KV", name: k, from: kvString(l), to: kvString(d), action: d.action})
+		}
+	}
+	for _, k := range sortedKeys(live.kv) {
+		if _, ok := desired.kv[k]; ok {
+			continue
+		}
+		if a, ok := desired.ownsKV(k); ok && live.kv[k].present {
+			add(change{op: "-", kind: "KV", name: k, from: kvString(live.kv[k]), action: a})
+		}
+	}
+
+	var acls []string
+	for k := range desired.acl {
+		acls = append(acls, k)
+	}
+	sort.Strings(acls)
+	for _, k := range acls {
+		d := desired.acl[k]
+		l, ok := live.acl[k]
+		switch {
+		case d.present && (!ok || !l.present):
+			add(change{op: "+", kind: "ACL", name: k, to: fmt.Sprintf("%q", d.rules), action: d.action})
+		case !d.present && ok && l.present:
+			add(change{op: "-", kind: "ACL", name: k, from: fmt.Sprintf("%q", l.rules), action: d.action})
+		case d.present && d.rules != l.rules:
+			add(change{op: "~", kind: "ACL", name: k, from: fmt.Sprintf("%q", l.rules), to: fmt.Sprintf("%q", d.rules), action: d.action})
+		}
+	}
+
+	var nodes []string
+	for k := range desired.nodes {
+		nodes = append(nodes, k)
+	}
+	sort.Strings(nodes)
+	for _, k := range nodes {
+		d := desired.nodes[k]
+		l, ok := live.nodes[k]
+		if !ok {
+			l = &nodeItem{services: make(map[string]*serviceItem)}
+		}
+		if d.managed {
+			switch {
+			case d.present && !l.present:
+				add(change{op: "+", kind: "Node", name: k, to: fmt.Sprintf("%q", d.address), action: d.action})
+			case !d.present && l.present:
+				add(change{op: "-", kind: "Node", name: k, from: fmt.Sprintf("%q", l.address), action: d.action})
+				continue
+			case d.present && d.address != l.address:
+				add(change{op: "~", kind: "Node", name: k, from: fmt.Sprintf("%q", l.address), to: fmt.Sprintf("%q", d.address), action: d.action})
+			}
+		}
+		var ids []string
+		for id := range d.services {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			ds := d.services[id]
+			ls, ok := l.services[id]
+			name := k + "/" + id
+			switch {
+			case ds.present && (!ok || !ls.present):
+				add(change{op: "+", kind: "Service", name: name, to: serviceString(ds), action: ds.action})
+			case !ds.present && ok && ls.present:
+				add(change{op: "-", kind: "Service", name: name, from: serviceString(ls), action: ds.action})
+			case ds.present && serviceString(ds) != serviceString(ls):
+				add(change{op: "~", kind: "Service", name: name, from: serviceString(ls), to: serviceString(ds), action: ds.action})
+			}
+		}
+	}
+
+	var queries []string
+	for k := range desired.queries {
+		queries = append(queries, k)
+	}
+	sort.Strings(queries)
+	for _, k := range queries {
+		d := desired.queries[k]
+		l, ok := live.queries[k]
+		switch {
+		case d.present && (!ok || !l.present):
+			add(change{op: "+", kind: "PreparedQuery", name: k, to: d.value, action: d.action})
+		case !d.present && ok && l.present:
+			add(change{op: "-", kind: "PreparedQuery", name: k, from: l.value, action: d.action})
+		case d.present && d.value != l.value:
+			add(change{op: "~", kind: "PreparedQuery", name: k, from: l.value, to: d.value, action: d.action})
+		}
+	}
+
+	var entries []string
+	for k := range desired.configEntries {
+		entries = append(entries, k)
+	}
+	sort.Strings(entries)
+	for _, k := range entries {
+		d := desired.configEntries[k]
+		l, ok := live.configEntries[k]
+		switch {
+		case d.present && (!ok || !l.present):
+			add(change{op: "+", kind: "ConfigEntry", name: k, to: entryString(d.entry), action: d.action})
+		case !d.present && ok && l.present:
+			add(change{op: "-", kind: "ConfigEntry", name: k, from: entryString(l.entry), action: d.action})
+		case d.present && !jsonCovers(d.entry, l.entry):
+			add(change{op: "~", kind: "ConfigEntry", name: k, from: entryString(l.entry), to: entryString(d.entry), action: d.action})
+		}
+	}
+	return changes
+}
+
+// jsonCovers reports whether the live JSON value l is what the desired value
+// d asks for. Fields of l that d does not give must hold a zero value, which
+// is how consul fills in the fields of a config entry that were not set.
+func jsonCovers(d, l interface{}) bool {
+	dm, dok := d.(map[string]interface{})
+	lm, lok := l.(map[string]interface{})
+	if dok && lok {
+		for k, v := range dm {
+			if !jsonCovers(v, lm[k]) {
+				return false
+			}
+		}
+		for k, v := range lm {
+			if _, ok := dm[k]; !ok && !jsonZero(v) {
+				return false
+			}
+		}
+		return true
+	}
+	if jsonZero(d) && jsonZero(l) {
+		return true
+	}
+	return reflect.DeepEqual(d, l)
+}
+
+// jsonZero reports whether the JSON value is null, empty or zero.
+func jsonZero(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case json.Number:
+		f, err := v.Float64()
+		return err == nil && f == 0
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		for _, i := range v {
+			if !jsonZero(i) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func entryString(entry map[string]interface{}) string {
+	b, _ := json.Marshal(entry)
+	return string(b)
+}
+
+func sortedKeys(m map[string]*kvItem) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func kvString(i *kvItem) string {
+	if i.anyValue {
+		return fmt.Sprintf("%d %q (if not exist)", i.flags, i.value)
+	}
+	return fmt.Sprintf("%d %q", i.flags, i.value)
+}
+
+func serviceString(i *serviceItem) string {
+	tags := append([]string(nil), i.tags...)
+	sort.Strings(tags)
+	return fmt.Sprintf("%q %q %d", i.service, strings.Join(tags, ", "), i.port)
+}
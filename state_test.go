@@ -0,0 +1,199 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+func kvSet(key, value string) *action.KVSet {
+	return &action.KVSet{Key: key, KVValue: action.KVValue{Value: value}}
+}
+
+func TestCompare(t *testing.T) {
+	web := func(port int) *action.ExternalNodeService {
+		return &action.ExternalNodeService{Service: "web", Tags: []string{"b", "a"}, Port: port}
+	}
+	tests := []struct {
+		name    string
+		desired action.Actions
+		live    action.Actions
+		want    []string
+	}{
+		{
+			name:    "same",
+			desired: action.Actions{kvSet("a", "1"), &action.ACLSet{Name: "app", Rules: "r"}},
+			live:    action.Actions{kvSet("a", "1"), &action.ACLSet{Name: "app", Rules: "r"}},
+		},
+		{
+			name:    "add key",
+			desired: action.Actions{kvSet("a", "1")},
+			want:    []string{`+ KV "a" 0 "1"`},
+		},
+		{
+			name:    "update key",
+			desired: action.Actions{kvSet("a", "2")},
+			live:    action.Actions{kvSet("a", "1")},
+			want:    []string{`~ KV "a" 0 "1" => 0 "2"`},
+		},
+		{
+			name:    "update flags",
+			desired: action.Actions{&action.KVSet{Key: "a", Flags: 2, KVValue: action.KVValue{Value: "1"}}},
+			live:    action.Actions{kvSet("a", "1")},
+			want:    []string{`~ KV "a" 0 "1" => 2 "1"`},
+		},
+		{
+			name:    "delete key",
+			desired: action.Actions{&action.KVDelete{Key: "a"}},
+			live:    action.Actions{kvSet("a", "1")},
+			want:    []string{`- KV "a" 0 "1"`},
+		},
+		{
+			name:    "delete missing key",
+			desired: action.Actions{&action.KVDelete{Key: "a"}},
+		},
+		{
+			name:    "set if not exist keeps any value",
+			desired: action.Actions{&action.KVSetIfNotExist{Key: "a", KVValue: action.KVValue{Value: "2"}}},
+			live:    action.Actions{kvSet("a", "1")},
+		},
+		{
+			name:    "set if not exist adds",
+			desired: action.Actions{&action.KVSetIfNotExist{Key: "a", KVValue: action.KVValue{Value: "2"}}},
+			want:    []string{`+ KV "a" 0 "2" (if not exist)`},
+		},
+		{
+			name:    "delete tree removes unmanaged keys",
+			desired: action.Actions{&action.KVDeleteTree{Prefix: "app/"}, kvSet("app/keep", "1")},
+			live:    action.Actions{kvSet("app/keep", "1"), kvSet("app/old", "x"), kvSet("other", "y")},
+			want:    []string{`- KV "app/old" 0 "x"`},
+		},
+		{
+			name:    "later action wins",
+			desired: action.Actions{kvSet("a", "1"), &action.KVDelete{Key: "a"}, kvSet("a", "3")},
+			live:    action.Actions{kvSet("a", "3")},
+		},
+		{
+			name:    "add acl",
+			desired: action.Actions{&action.ACLSet{Name: "app", Rules: "r"}},
+			want:    []string{`+ ACL "app" "r"`},
+		},
+		{
+			name:    "update acl",
+			desired: action.Actions{&action.ACLSet{Name: "app", Rules: "new"}},
+			live:    action.Actions{&action.ACLSet{Name: "app", Rules: "old"}},
+			want:    []string{`~ ACL "app" "old" => "new"`},
+		},
+		{
+			name:    "delete acl",
+			desired: action.Actions{&action.ACLDelete{Name: "app"}},
+			live:    action.Actions{&action.ACLSet{Name: "app", Rules: "r"}},
+			want:    []string{`- ACL "app" "r"`},
+		},
+		{
+			name:    "add node",
+			desired: action.Actions{&action.ExternalNodeRegister{Node: "n1", Address: "10.0.0.1", Services: []*action.ExternalNodeService{web(80)}}},
+			want:    []string{`+ Node "n1" "10.0.0.1"`, `+ Service "n1/web" "web" "a, b" 80`},
+		},
+		{
+			name:    "update node and service",
+			desired: action.Actions{&action.ExternalNodeRegister{Node: "n1", Address: "10.0.0.2", Services: []*action.ExternalNodeService{web(8080)}}},
+			live:    action.Actions{&action.ExternalNodeRegister{Node: "n1", Address: "10.0.0.1", Services: []*action.ExternalNodeService{web(80)}}},
+			want:    []string{`~ Node "n1" "10.0.0.1" => "10.0.0.2"`, `~ Service "n1/web" "web" "a, b" 80 => "web" "a, b" 8080`},
+		},
+		{
+			name:    "service tag order does not matter",
+			desired: action.Actions{&action.ExternalNodeRegister{Node: "n1", Address: "10.0.0.1", Services: []*action.ExternalNodeService{web(80)}}},
+			live: action.Actions{&action.ExternalNodeRegister{Node: "n1", Address: "10.0.0.1", Services: []*action.ExternalNodeService{
+				{Service: "web", Tags: []string{"a", "b"}, Port: 80},
+			}}},
+		},
+		{
+			name:    "delete node",
+			desired: action.Actions{&action.ExternalNodeDeregister{Node: "n1"}},
+			live:    action.Actions{&action.ExternalNodeRegister{Node: "n1", Address: "10.0.0.1", Services: []*action.ExternalNodeService{web(80)}}},
+			want:    []string{`- Node "n1" "10.0.0.1"`},
+		},
+		{
+			name:    "delete service",
+			desired: action.Actions{&action.ExternalNodeDeregister{Node: "n1", Services: []string{"web"}}},
+			live:    action.Actions{&action.ExternalNodeRegister{Node: "n1", Address: "10.0.0.1", Services: []*action.ExternalNodeService{web(80)}}},
+			want:    []string{`- Service "n1/web" "web" "a, b" 80`},
+		},
+		{
+			name:    "add query",
+			desired: action.Actions{&action.PreparedQuerySet{Name: "web", Service: "web"}},
+			want:    []string{`+ PreparedQuery "web" {"Name":"web","Service":"web"}`},
+		},
+		{
+			name:    "same query with tags in another order",
+			desired: action.Actions{&action.PreparedQuerySet{Name: "web", Service: "web", Tags: []string{"b", "a"}}},
+			live:    action.Actions{&action.PreparedQuerySet{Name: "web", Service: "web", Tags: []string{"a", "b"}}},
+		},
+		{
+			name:    "update query",
+			desired: action.Actions{&action.PreparedQuerySet{Name: "web", Service: "web", OnlyPassing: true}},
+			live:    action.Actions{&action.PreparedQuerySet{Name: "web", Service: "web"}},
+			want:    []string{`~ PreparedQuery "web" {"Name":"web","Service":"web"} => {"Name":"web","Service":"web","OnlyPassing":true}`},
+		},
+		{
+			name:    "template is not the query",
+			desired: action.Actions{&action.PreparedQuerySet{Name: "web", Service: "web", TemplateType: "name_prefix_match"}},
+			live:    action.Actions{&action.PreparedQuerySet{Name: "web", Service: "web"}},
+			want:    []string{`+ PreparedQuery "web (template)" {"Name":"web","Service":"web","TemplateType":"name_prefix_match"}`},
+		},
+		{
+			name:    "delete query",
+			desired: action.Actions{&action.PreparedQueryDelete{Name: "web"}},
+			live:    action.Actions{&action.PreparedQuerySet{Name: "web", Service: "web"}},
+			want:    []string{`- PreparedQuery "web" {"Name":"web","Service":"web"}`},
+		},
+		{
+			name:    "add config entry",
+			desired: action.Actions{&action.ConfigEntrySet{Kind: "service-defaults", Name: "web", Entry: []byte(`{"Protocol": "http"}`)}},
+			want:    []string{`+ ConfigEntry "service-defaults/web" {"Protocol":"http"}`},
+		},
+		{
+			name:    "config entry with empty fields filled in",
+			desired: action.Actions{&action.ConfigEntrySet{Kind: "service-defaults", Name: "web", Entry: []byte(`{"Protocol": "http"}`)}},
+			live:    action.Actions{&action.ConfigEntrySet{Kind: "service-defaults", Name: "web", Entry: []byte(`{"Protocol": "http", "MeshGateway": {"Mode": ""}, "Expose": {}}`)}},
+		},
+		{
+			name:    "config entry with an extra field",
+			desired: action.Actions{&action.ConfigEntrySet{Kind: "service-defaults", Name: "web", Entry: []byte(`{"Protocol": "http"}`)}},
+			live:    action.Actions{&action.ConfigEntrySet{Kind: "service-defaults", Name: "web", Entry: []byte(`{"Protocol": "http", "MeshGateway": {"Mode": "local"}}`)}},
+			want:    []string{`~ ConfigEntry "service-defaults/web" {"MeshGateway":{"Mode":"local"},"Protocol":"http"} => {"Protocol":"http"}`},
+		},
+		{
+			name:    "update config entry",
+			desired: action.Actions{&action.ConfigEntrySet{Kind: "service-defaults", Name: "web", Entry: []byte(`{"Protocol": "grpc"}`)}},
+			live:    action.Actions{&action.ConfigEntrySet{Kind: "service-defaults", Name: "web", Entry: []byte(`{"Protocol": "http"}`)}},
+			want:    []string{`~ ConfigEntry "service-defaults/web" {"Protocol":"http"} => {"Protocol":"grpc"}`},
+		},
+		{
+			name:    "delete config entry",
+			desired: action.Actions{&action.ConfigEntryDelete{Kind: "service-defaults", Name: "web"}},
+			live:    action.Actions{&action.ConfigEntrySet{Kind: "service-defaults", Name: "web"}},
+			want:    []string{`- ConfigEntry "service-defaults/web" {}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			desired, live := newState(), newState()
+			if err := desired.apply(tt.desired); err != nil {
+				t.Fatal(err)
+			}
+			if err := live.apply(tt.live); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, c := range compare(desired, live) {
+				got = append(got, c.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
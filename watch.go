@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+// watchApply applies the actions in the files and then keeps applying the
+// actions that change until the process is stopped.
+func watchApply(r *applier, filenames []string, interval time.Duration) {
+	var (
+		stamp   string
+		applied = make(map[string]bool)
+		files   = filenames
+	)
+	logf("Watching %q.", filenames)
+	for ; ; time.Sleep(interval) {
+		if r.stopped() != nil {
+			return
+		}
+		s := watchStamp(files)
+		if s == stamp {
+			continue
+		}
+		stamp = s
+		actions, options, err := loadJSONActions(filenames...)
+		if err == nil {
+			err = flagApply.rewrite.rewrite(actions, options)
+		}
+		if err != nil {
+			logError(err)
+			continue
+		}
+		files = append(append([]string(nil), filenames...), referencedFiles(actions)...)
+		stamp = watchStamp(files)
+		r.options = options
+
+		done := make(map[string]bool, len(actions))
+		seen := make(map[string]int, len(actions))
+		for o, a := range actions {
+			if r.stopped() != nil {
+				return
+			}
+			f, err := fingerprint(a)
+			f = watchKey(seen, f)
+			if err == nil && !applied[f] {
+				if r.dry {
+					logf("would apply %s", a)
+					emit(r.event("planned", o, a))
+				} else {
+					var d time.Duration
+					d, err = r.run(a)
+					if err == errConditionFalse {
+						// Try again on the next change, as the condition may
+						// hold by then.
+						logf("%s %s", errConditionFalse, a)
+						e := r.event("skipped", o, a)
+						e.Message = errConditionFalse.Error()
+						emit(e)
+						continue
+					}
+					if err == nil {
+						logf("applied %s", a)
+						e := r.event("applied", o, a)
+						e.Duration = d.Seconds()
+						emit(e)
+					}
+				}
+			}
+			if err != nil {
+				// Later actions may depend on this one, so stop here and
+				// try again on the next change.
+				logf("failed %s, %s", a, err)
+				emit(errorEvent(r.options.actionError("apply", o, a, err)))
+				break
+			}
+			done[f] = true
+		}
+		if !r.dry {
+			applied = done
+		}
+		if len(done) == len(actions) {
+			metrics.success()
+		}
+		emit(event{Event: "summary", Summary: map[string]int{"actions": len(actions), "done": len(done)}})
+	}
+}
+
+// watchKey identifies an action with content fingerprint f between runs.
+// The same action can be given more than once, for example to set a key
+// back after another action has changed it, so the key also counts how many
+// times f has been seen in the list. Unlike the position of the action, that
+// does not change when other actions are added or removed.
+func watchKey(seen map[string]int, f string) string {
+	seen[f]++
+	return fmt.Sprintf("%s %d", f, seen[f])
+}
+
+// referencedFiles returns the files that the actions read.
+func referencedFiles(actions action.Actions) []string {
+	var files []string
+	for _, a := range actions {
+		if r, ok := a.(action.FileReferencer); ok {
+			files = append(files, r.Files()...)
+		}
+	}
+	return files
+}
+
+// watchStamp summarises the size and modification time of the files, and
+// of everything under them when they are directories.
+func watchStamp(files []string) string {
+	h := sha256.New()
+	for _, f := range files {
+		filepath.Walk(f, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintf(h, "%s error\n", path)
+				return nil
+			}
+			fmt.Fprintf(h, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+			return nil
+		})
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// fingerprint identifies the content of an action, including the content
+// of any files that it reads.
+func fingerprint(a action.Actioner) (string, error) {
+	h := sha256.New()
+	io.WriteString(h, a.Type())
+	err := json.NewEncoder(h).Encode(a)
+	if err != nil {
+		return "", err
+	}
+	if r, ok := a.(action.FileReferencer); ok {
+		for _, f := range r.Files() {
+			err = filepath.Walk(f, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				file, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				io.WriteString(h, path)
+				_, err = io.Copy(h, file)
+				return err
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/williambailey/consul-register/action"
+)
+
+// watchKeys returns the watch key of each action.
+func watchKeys(t *testing.T, actions action.Actions) []string {
+	seen := make(map[string]int)
+	var keys []string
+	for _, a := range actions {
+		f, err := fingerprint(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, watchKey(seen, f))
+	}
+	return keys
+}
+
+func TestWatchKey(t *testing.T) {
+	mode := func() action.Actioner { return kvSet("app/mode", "on") }
+	tests := []struct {
+		name   string
+		before action.Actions
+		after  action.Actions
+		// same is, for each action in after, the action in before with
+		// the same key, or -1 when there is none.
+		same []int
+	}{
+		{
+			name:   "identical at different positions",
+			before: action.Actions{mode(), kvSet("app/x", "1"), mode()},
+			after:  action.Actions{mode(), kvSet("app/x", "1"), mode()},
+			same:   []int{0, 1, 2},
+		},
+		{
+			name:   "item inserted at the top",
+			before: action.Actions{mode(), kvSet("app/x", "1"), mode()},
+			after:  action.Actions{kvSet("new", "1"), mode(), kvSet("app/x", "1"), mode()},
+			same:   []int{-1, 0, 1, 2},
+		},
+		{
+			name:   "item removed",
+			before: action.Actions{kvSet("old", "1"), mode(), kvSet("app/x", "1")},
+			after:  action.Actions{mode(), kvSet("app/x", "1")},
+			same:   []int{1, 2},
+		},
+		{
+			name:   "repeat added",
+			before: action.Actions{mode()},
+			after:  action.Actions{mode(), mode()},
+			same:   []int{0, -1},
+		},
+		{
+			name:   "changed",
+			before: action.Actions{mode(), kvSet("app/x", "1")},
+			after:  action.Actions{mode(), kvSet("app/x", "2")},
+			same:   []int{0, -1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := make(map[string]int)
+			for o, k := range watchKeys(t, tt.before) {
+				if _, ok := before[k]; ok {
+					t.Fatalf("key %q is used twice", k)
+				}
+				before[k] = o
+			}
+			for o, k := range watchKeys(t, tt.after) {
+				got, ok := before[k]
+				if !ok {
+					got = -1
+				}
+				if got != tt.same[o] {
+					t.Errorf("action %d has the key of action %d, want %d", o, got, tt.same[o])
+				}
+			}
+		})
+	}
+}